@@ -0,0 +1,224 @@
+// File: accounts.go - Registered nicks protected by a password
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Registration is optional, guests log in with just a nick as before.
+//  - A registered nick, and its look-alikes, can only be used with its password.
+//  - Passwords are kept as salted PBKDF2-SHA256 hashes in <datadir>/nicks.json.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// PBKDF2 work factor of new hashes, stored ones keep their own.
+	passwordIterations = 600_000
+	passwordSaltSize   = 16
+	passwordHashSize   = 32
+
+	minPasswordLength = 8
+	maxPasswordLength = 256
+)
+
+var (
+	errWrongPassword = errors.New("Wrong password.")
+	errNotRegistered = errors.New("This nick is not registered.")
+)
+
+// NickAccount is a registered nick as stored on disk.
+type NickAccount struct {
+	Nick       string    `json:"nick"`
+	Salt       []byte    `json:"salt"`
+	Hash       []byte    `json:"hash"`
+	Iterations int       `json:"iterations"`
+	Registered time.Time `json:"registered"`
+}
+
+// AccountStore holds the registered nicks, keyed by their skeleton.
+type AccountStore struct {
+	mu       sync.Mutex
+	path     string
+	accounts map[string]NickAccount
+}
+
+var accounts *AccountStore
+
+// openAccountStore; Loads the registered nicks from dir, a missing file is an
+// empty store.
+func openAccountStore(dir string) (*AccountStore, error) {
+	s := &AccountStore{
+		path:     filepath.Join(dir, "nicks.json"),
+		accounts: make(map[string]NickAccount),
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []NickAccount
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", s.path, err)
+	}
+	for _, account := range list {
+		s.accounts[nickSkeleton(account.Nick)] = account
+	}
+	return s, nil
+}
+
+// save; Writes all accounts to disk. Caller holds s.mu.
+// Failures are logged, the error returned is fit for the client.
+func (s *AccountStore) save() error {
+	if err := s.write(); err != nil {
+		logger("ERROR", "Failed to save registered nicks:", err)
+		return errors.New("Failed to save, try again later.")
+	}
+	return nil
+}
+
+// write; Replaces nicks.json with the accounts in memory.
+func (s *AccountStore) write() error {
+	list := make([]NickAccount, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		list = append(list, account)
+	}
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// registered; Returns true if nick or a look-alike of it is registered.
+func (s *AccountStore) registered(nick string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.accounts[nickSkeleton(nick)]
+	return ok
+}
+
+// verify; Checks password against the account of nick, returns the nick as
+// it was registered.
+func (s *AccountStore) verify(nick string, password string) (string, error) {
+	s.mu.Lock()
+	account, ok := s.accounts[nickSkeleton(nick)]
+	s.mu.Unlock()
+	if !ok {
+		return "", errNotRegistered
+	}
+
+	hash := pbkdf2.Key([]byte(password), account.Salt, account.Iterations, len(account.Hash), sha256.New)
+	if subtle.ConstantTimeCompare(hash, account.Hash) != 1 {
+		return "", errWrongPassword
+	}
+	return account.Nick, nil
+}
+
+// register; Registers nick with password, fails if it is taken.
+func (s *AccountStore) register(nick string, password string) error {
+	account, err := newNickAccount(nick, password)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := nickSkeleton(nick)
+	if _, ok := s.accounts[key]; ok {
+		return errors.New("This nick is already registered.")
+	}
+	s.accounts[key] = account
+	if err := s.save(); err != nil {
+		delete(s.accounts, key)
+		return err
+	}
+	return nil
+}
+
+// setPassword; Replaces the password of a registered nick.
+func (s *AccountStore) setPassword(nick string, password string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := nickSkeleton(nick)
+	old, ok := s.accounts[key]
+	if !ok {
+		return errNotRegistered
+	}
+
+	account, err := newNickAccount(old.Nick, password)
+	if err != nil {
+		return err
+	}
+	account.Registered = old.Registered
+	s.accounts[key] = account
+	if err := s.save(); err != nil {
+		s.accounts[key] = old
+		return err
+	}
+	return nil
+}
+
+// unregister; Drops the registration of nick, it is free to use again.
+func (s *AccountStore) unregister(nick string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := nickSkeleton(nick)
+	old, ok := s.accounts[key]
+	if !ok {
+		return errNotRegistered
+	}
+	delete(s.accounts, key)
+	if err := s.save(); err != nil {
+		s.accounts[key] = old
+		return err
+	}
+	return nil
+}
+
+// newNickAccount; Hashes password with a new salt.
+func newNickAccount(nick string, password string) (NickAccount, error) {
+	length := utf8.RuneCountInString(password)
+	if length < minPasswordLength {
+		return NickAccount{}, fmt.Errorf("Password must be at least %d characters.", minPasswordLength)
+	}
+	if length > maxPasswordLength {
+		return NickAccount{}, fmt.Errorf("Password can't be longer than %d characters.", maxPasswordLength)
+	}
+
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return NickAccount{}, err
+	}
+	return NickAccount{
+		Nick:       nick,
+		Salt:       salt,
+		Hash:       pbkdf2.Key([]byte(password), salt, passwordIterations, passwordHashSize, sha256.New),
+		Iterations: passwordIterations,
+		Registered: time.Now().UTC(),
+	}, nil
+}
+
+// adminToken; Returns true if token matches -admintoken, never if it is unset.
+func adminToken(token string) bool {
+	return *adminTokenFlag != "" && subtle.ConstantTimeCompare([]byte(token), []byte(*adminTokenFlag)) == 1
+}
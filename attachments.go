@@ -0,0 +1,496 @@
+// File: attachments.go - Uploaded files, stored on disk by content hash
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - POST /upload stores a file under <datadir>/blobs and answers with its url.
+//    It takes the upload token of a logged in client, and each IP has the
+//    "upload" budget of -ratelimits.
+//  - GET /files/<hash> serves it back, with range requests.
+//  - Blobs no message in history points at are removed once they were not
+//    sent for a grace period, direct messages are not kept in history.
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// url prefix of stored files, relative so it works behind a path prefix.
+	blobURLPrefix = "files/"
+
+	// How often unreferenced blobs are looked for.
+	blobGCInterval = time.Hour
+
+	// Unreferenced blobs uploaded or sent within this are kept, the upload
+	// may not be sent yet, or was sent in a direct message.
+	blobGrace = 24 * time.Hour
+)
+
+var blobHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+var errBlobTooLarge = errors.New("file too large")
+
+// BlobMeta is stored next to each blob.
+type BlobMeta struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+
+	// images only, filled in when first sent.
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Thumb  string `json:"thumb,omitempty"` // hash of the thumbnail blob.
+}
+
+type UploadResponse struct {
+	Url  string `json:"url"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func blobDir() string {
+	return filepath.Join(*dataDir, "blobs")
+}
+
+// blobPath; Returns where the blob with hash is stored, fanned out by the
+// first two characters.
+func blobPath(hash string) string {
+	return filepath.Join(blobDir(), hash[:2], hash)
+}
+
+// blobHash; Returns the hash of a stored file url, or "" for other urls.
+func blobHash(url string) string {
+	hash := strings.TrimPrefix(url, blobURLPrefix)
+	if hash == url || !blobHashPattern.MatchString(hash) {
+		return ""
+	}
+	return hash
+}
+
+// readBlobMeta; Reads the metadata stored with a blob.
+func readBlobMeta(hash string) (BlobMeta, error) {
+	var meta BlobMeta
+	data, err := os.ReadFile(blobPath(hash) + ".json")
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(data, &meta)
+	return meta, err
+}
+
+// storeBlob; Copies r into the blob store, returns its hash.
+// Fails with errBlobTooLarge if r holds more than limit bytes.
+func storeBlob(r io.Reader, meta BlobMeta, limit int64) (string, int64, error) {
+	if err := os.MkdirAll(blobDir(), 0o755); err != nil {
+		return "", 0, err
+	}
+	tmp, err := os.CreateTemp(blobDir(), ".upload.*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), io.LimitReader(r, limit+1))
+	if err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	if size > limit {
+		tmp.Close()
+		return "", 0, errBlobTooLarge
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	path := blobPath(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", 0, err
+	}
+
+	meta.Size = size
+	if old, err := readBlobMeta(hash); err == nil {
+		// keep what was worked out about the content already.
+		meta.Width, meta.Height, meta.Thumb = old.Width, old.Height, old.Thumb
+	}
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := writeFileAtomic(path+".json", metaJSON); err != nil {
+		return "", 0, err
+	}
+
+	// same content was uploaded before, just freshen it for the collector.
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return hash, size, nil
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+	return hash, size, nil
+}
+
+// allowedType; Returns true if the mime type matches the -mimetypes list.
+// Parameters such as charset are ignored.
+func allowedType(mimeType string) bool {
+	mimeType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range strings.Split(*allowedTypes, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "*" || allowed == mimeType {
+			return true
+		}
+		if strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffMismatch; Compares the declared mime type with what the content looks
+// like. Returns the sniffed type if they don't fit together, or "".
+func sniffMismatch(declared string, content []byte) string {
+	declared, _, _ = mime.ParseMediaType(declared)
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(content))
+	if sniffed == declared {
+		return ""
+	}
+
+	switch {
+	case sniffed == "text/html":
+		// browsers will happily render this, it must be declared as what it is.
+		return sniffed
+	case sniffed == "application/octet-stream", strings.HasPrefix(sniffed, "text/plain"):
+		// nothing recognised, but images always are. This also catches svg,
+		// which can carry scripts.
+		if strings.HasPrefix(declared, "image/") {
+			return sniffed
+		}
+		return ""
+	}
+
+	declaredKind, _, _ := strings.Cut(declared, "/")
+	sniffedKind, _, _ := strings.Cut(sniffed, "/")
+	if declaredKind == sniffedKind {
+		return ""
+	}
+	// mp4 and webm containers hold audio as often as video.
+	if (declaredKind == "audio" || declaredKind == "video") && (sniffedKind == "audio" || sniffedKind == "video") {
+		return ""
+	}
+	return sniffed
+}
+
+// validateAttachment; Checks the type and url of an attachment against the
+// -mimetypes list and its content. The returned error is meant for the sender.
+func validateAttachment(m *Message) error {
+	if m.Url == "" && m.Type == "" {
+		return nil
+	}
+	if m.Url == "" || m.Type == "" {
+		return errors.New("Attachments need both a type and a url.")
+	}
+
+	declared, _, err := mime.ParseMediaType(m.Type)
+	if err != nil {
+		return fmt.Errorf("Invalid file type %q.", m.Type)
+	}
+	if !allowedType(declared) {
+		return fmt.Errorf("Files of type %s are not allowed.", declared)
+	}
+
+	// our own stored files.
+	if hash := blobHash(m.Url); hash != "" {
+		meta, err := readBlobMeta(hash)
+		if err != nil {
+			return errors.New("The attached file was not found.")
+		}
+		if stored, _, _ := mime.ParseMediaType(meta.Type); stored != declared {
+			return fmt.Errorf("The attached file is %s, not %s.", stored, declared)
+		}
+		return nil
+	}
+
+	u, err := url.Parse(m.Url)
+	if err != nil {
+		return errors.New("Invalid attachment url.")
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		// can't look inside, the browser fetches it.
+		return nil
+	case "data":
+		mediaType, content, err := decodeDataURL(m.Url)
+		if err != nil {
+			return errors.New("Invalid data url.")
+		}
+		if urlType, _, _ := mime.ParseMediaType(mediaType); urlType != declared {
+			return fmt.Errorf("The data url is %s, not %s.", urlType, declared)
+		}
+		if sniffed := sniffMismatch(declared, content); sniffed != "" {
+			return fmt.Errorf("The file looks like %s, not %s.", sniffed, declared)
+		}
+		return nil
+	}
+	return errors.New("Attachment urls must be http, https or data urls.")
+}
+
+var (
+	uploadLimitsMu sync.Mutex
+	uploadLimits   = make(map[string]*RateLimiter) // client ip -> upload budget.
+)
+
+// allowUpload; Takes a token from the upload budget of ip. If there is none,
+// returns false and how long until there will be.
+func allowUpload(ip string) (bool, time.Duration) {
+	uploadLimitsMu.Lock()
+	defer uploadLimitsMu.Unlock()
+	limiter, ok := uploadLimits[ip]
+	if !ok {
+		limiter = newRateLimiter()
+		uploadLimits[ip] = limiter
+	}
+	return limiter.allow("upload")
+}
+
+// pruneUploadLimits; Forgets the budgets of IPs that uploaded nothing for a
+// while, their bucket is full again.
+func pruneUploadLimits(idle time.Duration) {
+	uploadLimitsMu.Lock()
+	defer uploadLimitsMu.Unlock()
+	for ip, limiter := range uploadLimits {
+		if limiter.idleFor() >= idle {
+			delete(uploadLimits, ip)
+		}
+	}
+}
+
+// handleUpload stores a multipart "file" field and answers with its url.
+func handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ip := clientIP(r)
+	if ban, banned := bans.ipBan(ip); banned {
+		logger("INFO", "Refused upload of banned", ip)
+		http.Error(w, ban.String(), http.StatusForbidden)
+		return
+	}
+	nick, err := uploader(r.Header.Get("X-Upload-Token"))
+	if err != nil {
+		http.Error(w, "Log in to upload files", http.StatusUnauthorized)
+		return
+	}
+	if ok, retry := allowUpload(ip); !ok {
+		w.Header().Set("Retry-After", fmt.Sprint(int(retry.Seconds())+1))
+		http.Error(w, "Too many uploads, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	limit := *maxUploadSize * 1024 * 1024
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1024*1024)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart upload", http.StatusBadRequest)
+		return
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "No file in upload", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Bad upload", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		meta := BlobMeta{
+			Type: part.Header.Get("Content-Type"),
+			Name: filepath.Base(part.FileName()),
+		}
+		if meta.Type == "" {
+			meta.Type = "application/octet-stream"
+		}
+		if meta.Name == "." || meta.Name == string(filepath.Separator) {
+			meta.Name = "file"
+		}
+		if !allowedType(meta.Type) {
+			http.Error(w, "File type not allowed", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// DetectContentType looks at 512 bytes at most.
+		content := bufio.NewReaderSize(part, 512)
+		head, err := content.Peek(512)
+		if err != nil && err != io.EOF {
+			http.Error(w, "Bad upload", http.StatusBadRequest)
+			return
+		}
+		if sniffed := sniffMismatch(meta.Type, head); sniffed != "" {
+			http.Error(w, fmt.Sprintf("File looks like %s, not %s", sniffed, meta.Type), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		hash, size, err := storeBlob(content, meta, limit)
+		var maxBytesErr *http.MaxBytesError
+		if errors.Is(err, errBlobTooLarge) || errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Max size of file is %dMB", *maxUploadSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			logger("ERROR", "Failed to store upload:", err)
+			http.Error(w, "Failed to store file", http.StatusInternalServerError)
+			return
+		}
+
+		logger("INFO", "Stored upload", meta.Name, "from", nick, "as", hash, "size", size)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(UploadResponse{
+			Url:  blobURLPrefix + hash,
+			Type: meta.Type,
+			Name: meta.Name,
+			Size: size,
+		})
+		return
+	}
+}
+
+// handleFile serves a stored blob, range requests are handled by ServeContent.
+func handleFile(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/"+blobURLPrefix)
+	if !blobHashPattern.MatchString(hash) {
+		http.NotFound(w, r)
+		return
+	}
+
+	meta, err := readBlobMeta(hash)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(blobPath(hash))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", meta.Type)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// an uploaded svg or html page must not run scripts on our origin.
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	disposition := "attachment"
+	if strings.HasPrefix(meta.Type, "image/") || strings.HasPrefix(meta.Type, "audio/") || strings.HasPrefix(meta.Type, "video/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": meta.Name}))
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+}
+
+// touchBlobs; Marks the stored files of m as just sent, they are kept for
+// blobGrace even if no message in history points at them.
+func touchBlobs(m Message) {
+	now := time.Now()
+	for _, url := range []string{m.Url, m.ThumbUrl} {
+		if hash := blobHash(url); hash != "" {
+			if err := os.Chtimes(blobPath(hash), now, now); err != nil && !os.IsNotExist(err) {
+				logger("ERROR", "Failed to mark", hash, "as used:", err)
+			}
+		}
+	}
+}
+
+// collectBlobs; Periodically removes blobs no stored message points at.
+func collectBlobs() {
+	ticker := time.NewTicker(blobGCInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := collectBlobsOnce(); err != nil {
+			logger("ERROR", "Failed to collect unused files:", err)
+		}
+		pruneUploadLimits(blobGCInterval)
+	}
+}
+
+func collectBlobsOnce() error {
+	referenced := make(map[string]bool)
+	err := history.Each(func(room string, msg MessageData) {
+		if hash := blobHash(msg.M.Url); hash != "" {
+			referenced[hash] = true
+		}
+		if hash := blobHash(msg.M.ThumbUrl); hash != "" {
+			referenced[hash] = true
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	err = filepath.WalkDir(blobDir(), func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		hash := d.Name()
+		if d.IsDir() || !blobHashPattern.MatchString(hash) || referenced[hash] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < blobGrace {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		os.Remove(path + ".json")
+		removed++
+		return nil
+	})
+	if removed > 0 {
+		logger("INFO", "Removed", removed, "unused files")
+	}
+	return err
+}
@@ -0,0 +1,435 @@
+// File: bans.go - Persistent nick, IP and CIDR bans
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Bans are by nick, look-alikes included, by IP or by CIDR range, with an
+//    optional expiry and reason. They are kept in -bans until they run out.
+//  - Banned IPs are refused with 403 before the WebSocket upgrade, banned nicks
+//    at login.
+//  - Moderators ban with the ban event, admins through /admin/bans with
+//    -admintoken.
+//  - Behind -trustedproxies the client IP is taken from X-Forwarded-For.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ban is a nick or IP ban as stored on disk.
+type Ban struct {
+	Nick   string    `json:"nick,omitempty"`
+	IP     string    `json:"ip,omitempty"`    // address or CIDR range.
+	Until  time.Time `json:"until,omitempty"` // zero never runs out.
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by,omitempty"`
+}
+
+// expired; Returns true if the ban ran out.
+func (b Ban) expired() bool {
+	return !b.Until.IsZero() && time.Now().After(b.Until)
+}
+
+// String; Describes the ban to the banned.
+func (b Ban) String() string {
+	text := "You are banned"
+	if !b.Until.IsZero() {
+		text += " until " + b.Until.Format(time.RFC1123)
+	}
+	if b.Reason != "" {
+		text += ": " + b.Reason
+	}
+	return text + "."
+}
+
+// BanList holds the active bans.
+type BanList struct {
+	mu   sync.Mutex
+	path string
+	bans []Ban
+}
+
+var bans *BanList
+
+// openBanList; Loads the bans from path, a missing file is an empty list.
+func openBanList(path string) (*BanList, error) {
+	list, err := readBans(path)
+	if err != nil {
+		return nil, err
+	}
+	return &BanList{path: path, bans: list}, nil
+}
+
+// readBans; Reads the bans file at path, a missing file has no bans.
+func readBans(path string) ([]Ban, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Ban
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, b := range list {
+		if b.IP == "" {
+			continue
+		}
+		if list[i].IP, err = normalizeBanIP(b.IP); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return list, nil
+}
+
+// reload; Replaces the bans with the ones in the file at path, for edits made
+// while running. On error the bans in memory are kept.
+func (l *BanList) reload(path string) error {
+	list, err := readBans(path)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.path = path
+	l.bans = list
+	return nil
+}
+
+// prune; Drops bans that ran out. Caller holds l.mu.
+func (l *BanList) prune() {
+	kept := l.bans[:0]
+	for _, b := range l.bans {
+		if !b.expired() {
+			kept = append(kept, b)
+		}
+	}
+	l.bans = kept
+}
+
+// save; Writes the bans to disk. Caller holds l.mu.
+func (l *BanList) save() error {
+	data, err := json.MarshalIndent(l.bans, "", "\t")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(l.path), 0o755)
+	}
+	if err == nil {
+		err = writeFileAtomic(l.path, data)
+	}
+	if err != nil {
+		logger("ERROR", "Failed to save bans:", err)
+		return errors.New("Failed to save, try again later.")
+	}
+	return nil
+}
+
+// add; Adds bans, replacing older ones of the same nick or IP.
+func (l *BanList) add(added ...Ban) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune()
+	for _, b := range added {
+		kept := l.bans[:0]
+		for _, old := range l.bans {
+			if !(b.Nick != "" && old.Nick != "" && sameNick(old.Nick, b.Nick)) && !(b.IP != "" && old.IP == b.IP) {
+				kept = append(kept, old)
+			}
+		}
+		l.bans = append(kept, b)
+	}
+	return l.save()
+}
+
+// remove; Lifts the bans of nick or ip, returns how many there were.
+func (l *BanList) remove(nick string, ip string) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune()
+	kept := l.bans[:0]
+	for _, b := range l.bans {
+		if (nick != "" && b.Nick != "" && sameNick(b.Nick, nick)) || (ip != "" && b.IP == ip) {
+			continue
+		}
+		kept = append(kept, b)
+	}
+	removed := len(l.bans) - len(kept)
+	l.bans = kept
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, l.save()
+}
+
+// list; Returns a copy of the active bans.
+func (l *BanList) list() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	active := []Ban{}
+	for _, b := range l.bans {
+		if !b.expired() {
+			active = append(active, b)
+		}
+	}
+	return active
+}
+
+// nickBan; Returns the active ban of nick or a look-alike.
+func (l *BanList) nickBan(nick string) (Ban, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range l.bans {
+		if b.Nick != "" && !b.expired() && sameNick(b.Nick, nick) {
+			return b, true
+		}
+	}
+	return Ban{}, false
+}
+
+// ipBan; Returns the active ban of ip, or of a range it is in.
+func (l *BanList) ipBan(ip string) (Ban, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range l.bans {
+		if b.IP != "" && !b.expired() && ipInRange(ip, b.IP) {
+			return b, true
+		}
+	}
+	return Ban{}, false
+}
+
+// normalizeBanIP; Checks s is an IP or CIDR range and returns its canonical
+// form, ranges with the host bits cleared.
+func normalizeBanIP(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return "", fmt.Errorf("Invalid CIDR range %q.", s)
+		}
+		return prefix.Masked().String(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", fmt.Errorf("Invalid IP %q.", s)
+	}
+	return addr.Unmap().String(), nil
+}
+
+// ipInRange; Returns true if ip is the IP or in the CIDR range ipOrRange.
+func ipInRange(ip string, ipOrRange string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	if strings.Contains(ipOrRange, "/") {
+		prefix, err := netip.ParsePrefix(ipOrRange)
+		return err == nil && prefix.Contains(addr)
+	}
+	other, err := netip.ParseAddr(ipOrRange)
+	return err == nil && other.Unmap() == addr
+}
+
+// remoteIP; Returns the IP part of a peer address.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip.Unmap().String()
+	}
+	return host
+}
+
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies; Parses -trustedproxies, a comma separated list of
+// IPs and CIDR ranges.
+func parseTrustedProxies(spec string) error {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		normalized, err := normalizeBanIP(entry)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(normalized, "/") {
+			addr := netip.MustParseAddr(normalized)
+			normalized = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		proxies = append(proxies, netip.MustParsePrefix(normalized))
+	}
+	trustedProxies = proxies
+	return nil
+}
+
+// trustedProxy; Returns true if ip is one of -trustedproxies.
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP; Returns the IP of the client behind r. Requests from a trusted
+// proxy are traced back through X-Forwarded-For, right to left, to the first
+// address that is not a trusted proxy.
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r.RemoteAddr)
+	if !trustedProxy(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIP := r.Header.Get("X-Real-Ip"); realIP != "" {
+			hops = []string{realIP}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := remoteIP(strings.TrimSpace(hops[i]))
+		if _, err := netip.ParseAddr(hop); err != nil {
+			// garbage in the header, stop at the last address we trust.
+			break
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// BanRequest is the body of POST /admin/bans.
+type BanRequest struct {
+	Nick     string `json:"nick"`
+	IP       string `json:"ip"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// handleBans; Admin endpoint for bans, authorized by -admintoken as a bearer
+// token. GET lists the active bans, POST adds one, DELETE ?ip= or ?nick=
+// lifts them.
+func handleBans(w http.ResponseWriter, r *http.Request) {
+	if *adminTokenFlag == "" {
+		http.NotFound(w, r)
+		return
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !adminToken(token) {
+		logger("INFO", "Bad admin token from", clientIP(r))
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(bans.list())
+
+	case http.MethodPost:
+		var req BanRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ban := Ban{Reason: req.Reason, By: "admin"}
+		if req.Nick != "" {
+			nick, err := normalizeNick(req.Nick)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ban.Nick = nick
+		}
+		if req.IP != "" {
+			ip, err := normalizeBanIP(req.IP)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ban.IP = ip
+		}
+		if ban.Nick == "" && ban.IP == "" {
+			http.Error(w, "Name a nick or an IP to ban.", http.StatusBadRequest)
+			return
+		}
+		d, err := parseBanDuration(req.Duration, 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if d > 0 {
+			ban.Until = time.Now().Add(d).UTC()
+		}
+
+		if err := bans.add(ban); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		target := strings.TrimSpace(ban.Nick + " " + ban.IP)
+		logger("INFO", "Admin banned", target, forDuration(d), "reason:", req.Reason)
+		for _, hub := range throwOut(ban.Nick, ban.IP, closeBanned, ban.String()) {
+			roomNotice(hub, withReason(target+" was banned "+forDuration(d), req.Reason))
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ban)
+
+	case http.MethodDelete:
+		nick, ip := r.URL.Query().Get("nick"), r.URL.Query().Get("ip")
+		if ip != "" {
+			normalized, err := normalizeBanIP(ip)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			ip = normalized
+		}
+		if nick == "" && ip == "" {
+			http.Error(w, "Name a nick or an IP to unban.", http.StatusBadRequest)
+			return
+		}
+		removed, err := bans.remove(nick, ip)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if removed == 0 {
+			http.Error(w, "Not banned.", http.StatusNotFound)
+			return
+		}
+		logger("INFO", "Admin unbanned", strings.TrimSpace(nick+" "+ip))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeBanIP(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1":          "10.0.0.1",
+		" 10.0.0.1 ":        "10.0.0.1",
+		"::ffff:10.0.0.1":   "10.0.0.1",
+		"2001:DB8::1":       "2001:db8::1",
+		"10.1.2.3/8":        "10.0.0.0/8",
+		"2001:db8::1/32":    "2001:db8::/32",
+		"192.168.1.0/24":    "192.168.1.0/24",
+		"0.0.0.0/0":         "0.0.0.0/0",
+		"fe80::1%eth0":      "fe80::1%eth0",
+		"2001:db8:1::/48  ": "2001:db8:1::/48",
+	}
+	for ip, want := range tests {
+		got, err := normalizeBanIP(ip)
+		if err != nil || got != want {
+			t.Errorf("normalizeBanIP(%q) = %q, %v, want %q", ip, got, err, want)
+		}
+	}
+	for _, ip := range []string{"", "alice", "10.0.0", "10.0.0.1/33", "10.0.0.256", "10.0.0.1/x"} {
+		if got, err := normalizeBanIP(ip); err == nil {
+			t.Errorf("normalizeBanIP(%q) = %q, want an error", ip, got)
+		}
+	}
+}
+
+func TestIPInRange(t *testing.T) {
+	tests := []struct {
+		ip, ipOrRange string
+		want          bool
+	}{
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1", "10.0.0.2", false},
+		{"10.0.0.1", "10.0.0.0/8", true},
+		{"11.0.0.1", "10.0.0.0/8", false},
+		{"::ffff:10.0.0.1", "10.0.0.0/8", true},
+		{"::ffff:10.0.0.1", "10.0.0.1", true},
+		{"2001:db8::5", "2001:db8::/32", true},
+		{"2001:db9::5", "2001:db8::/32", false},
+		{"10.0.0.1", "::/0", false},
+		{"not an ip", "10.0.0.0/8", false},
+		{"10.0.0.1", "garbage", false},
+	}
+	for _, test := range tests {
+		if got := ipInRange(test.ip, test.ipOrRange); got != test.want {
+			t.Errorf("ipInRange(%q, %q) = %v, want %v", test.ip, test.ipOrRange, got, test.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	t.Cleanup(func() { trustedProxies = nil })
+	if err := parseTrustedProxies("10.0.0.1, 192.168.0.0/16,,::1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(trustedProxies) != 3 {
+		t.Errorf("%d proxies, want 3", len(trustedProxies))
+	}
+	for ip, want := range map[string]bool{"10.0.0.1": true, "10.0.0.2": false, "192.168.4.4": true, "::1": true, "::ffff:10.0.0.1": true} {
+		if got := trustedProxy(ip); got != want {
+			t.Errorf("trustedProxy(%q) = %v, want %v", ip, got, want)
+		}
+	}
+	if err := parseTrustedProxies("10.0.0.1,proxy.local"); err == nil {
+		t.Error("a host name was accepted")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	t.Cleanup(func() { trustedProxies = nil })
+	if err := parseTrustedProxies("10.0.0.1,10.0.1.0/24"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{"direct", "203.0.113.5:1234", nil, "", "203.0.113.5"},
+		{"untrusted peer can't forge", "203.0.113.5:1234", []string{"1.2.3.4"}, "", "203.0.113.5"},
+		{"through a proxy", "10.0.0.1:1234", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"through two proxies", "10.0.0.1:1234", []string{"198.51.100.7, 10.0.1.9"}, "", "198.51.100.7"},
+		{"forged left part", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.7"}, "", "198.51.100.7"},
+		{"several headers", "10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.7"}, "", "198.51.100.7"},
+		{"garbage stops", "10.0.0.1:1234", []string{"198.51.100.7, junk"}, "", "10.0.0.1"},
+		{"port in header", "10.0.0.1:1234", []string{"198.51.100.7:5555"}, "", "198.51.100.7"},
+		{"only proxies", "10.0.0.1:1234", []string{"10.0.1.2"}, "", "10.0.1.2"},
+		{"x-real-ip", "10.0.0.1:1234", nil, "198.51.100.8", "198.51.100.8"},
+		{"no headers", "10.0.0.1:1234", nil, "", "10.0.0.1"},
+		{"mapped peer", "[::ffff:10.0.0.1]:1234", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"ipv6 client", "10.0.0.1:1234", []string{"2001:db8::7"}, "", "2001:db8::7"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = test.remote
+		for _, value := range test.xff {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-Ip", test.realIP)
+		}
+		if got := clientIP(r); got != test.want {
+			t.Errorf("%s: clientIP = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/fasthttp/websocket"
@@ -37,12 +38,39 @@ var upgrader = websocket.Upgrader{
 }
 
 type Client struct {
-	hub    *Hub
-	conn   *websocket.Conn
-	send   chan []byte
-	events *EventManager
-	nick   string
-	id     string
+	conn     *websocket.Conn
+	send     chan []byte
+	events   *EventManager
+	id       string
+	limiter  *RateLimiter
+	session  string // resume session id, see sessions.go.
+	ip       string
+	presence presence
+
+	// Changed by the client's own goroutine, read by others, see nick and hub.
+	name atomic.Pointer[string]
+	room atomic.Pointer[Hub]
+}
+
+// nick; Returns the nick of c, empty until it logs in.
+func (c *Client) nick() string {
+	if name := c.name.Load(); name != nil {
+		return *name
+	}
+	return ""
+}
+
+func (c *Client) setNick(nick string) {
+	c.name.Store(&nick)
+}
+
+// hub; Returns the room c is in.
+func (c *Client) hub() *Hub {
+	return c.room.Load()
+}
+
+func (c *Client) setHub(hub *Hub) {
+	c.room.Store(hub)
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -52,7 +80,7 @@ type Client struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub().remove(c)
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(*maxMessageSize * 1024 * 1024)
@@ -65,7 +93,7 @@ func (c *Client) readPump() {
 	for {
 		_, msg, err := c.conn.ReadMessage()
 		if err != nil {
-			c.hub.unregister <- c
+			c.hub().remove(c)
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				logger("ERROR", err)
 			}
@@ -90,6 +118,21 @@ func (c *Client) readPump() {
 		//logger("DEBUG", "Parsed Event:", message.Event)
 		//logger("DEBUG", "Raw Data:", string(message.Data))
 
+		// Drop events over the client's budget
+		if ok, retryAfter := c.limiter.allow(message.Event); !ok {
+			if c.limiter.reject() {
+				logger("INFO", "Disconnecting", c.id, c.nick(), "for flooding", message.Event)
+				// kicked, it must not resume with its token.
+				endSession(c)
+				c.hub().remove(c)
+				c.events.Emit("disconnect", c, nil)
+				break
+			}
+			rateLimited(c, message.Event, retryAfter)
+			continue
+		}
+		c.active(message.Event)
+
 		// Check if the event exists before calling it
 		if handler, exists := c.events.handlers[message.Event]; exists {
 			//logger("DEBUG", "Emitting event:", message.Event)
@@ -123,6 +166,10 @@ func (c *Client) writePump() {
 			}
 
 			err := c.conn.WriteMessage(websocket.TextMessage, message)
+			if err == websocket.ErrCloseSent {
+				// kicked or banned, see throwOut.
+				return
+			}
 			if err != nil {
 				logger("ERROR", "Failed to send WebSocket message:", err)
 				return
@@ -139,19 +186,29 @@ func (c *Client) writePump() {
 
 // serveWs handles websocket requests from the peer.
 func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request, events *EventManager) {
+	ip := clientIP(r)
+	if ban, banned := bans.ipBan(ip); banned {
+		logger("INFO", "Refused banned", ip)
+		http.Error(w, ban.String(), http.StatusForbidden)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 	client := &Client{
-		hub:    hub,
-		conn:   conn,
-		send:   make(chan []byte, 256),
-		events: events,
-		id:     uuid.NewString(),
+		conn:     conn,
+		send:     make(chan []byte, 256),
+		events:   events,
+		id:       uuid.NewString(),
+		limiter:  newRateLimiter(),
+		ip:       ip,
+		presence: presence{state: presenceOnline, active: time.Now()},
 	}
-	client.hub.register <- client
+	client.setHub(hub)
+	hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
@@ -0,0 +1,374 @@
+// File: commands.go - Slash commands typed into send-msg
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Like EventManager.On, commands.On registers a handler for "/name".
+//  - Handlers get the caller's *Client and the text after the name. They
+//    answer privately with reply, or post to the room.
+//  - A returned error goes only to the caller, so do unknown commands.
+//  - Team commands are registered in main, next to the built-in ones.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+)
+
+type CommandHandler func(client *Client, args string) error
+
+type Command struct {
+	Name      string
+	Usage     string // arguments, e.g. "<nick> [reason]".
+	Help      string
+	Moderator bool // listed by /help for moderators only.
+	Handler   CommandHandler
+}
+
+// String; Describes the command for /help.
+func (command *Command) String() string {
+	usage := "/" + command.Name
+	if command.Usage != "" {
+		usage += " " + command.Usage
+	}
+	return usage + " - " + command.Help
+}
+
+type CommandManager struct {
+	commands map[string]*Command
+}
+
+func NewCommandManager() *CommandManager {
+	return &CommandManager{
+		commands: make(map[string]*Command),
+	}
+}
+
+func (cm *CommandManager) On(command Command) {
+	logger("DEBUG", "Registering command:", "/"+command.Name)
+	cm.commands[strings.ToLower(command.Name)] = &command
+}
+
+// Run; Runs the command in text, a message starting with "/".
+func (cm *CommandManager) Run(c *Client, text string) {
+	name, args, _ := strings.Cut(strings.TrimPrefix(text, "/"), " ")
+	command, found := cm.commands[strings.ToLower(name)]
+	if !found {
+		sendError(c, fmt.Sprintf("Unknown command /%s, see /help.", name))
+		return
+	}
+
+	logger("DEBUG", c.nick(), "runs", "/"+command.Name)
+	if err := command.Handler(c, strings.TrimSpace(args)); err != nil {
+		sendError(c, err.Error())
+	}
+}
+
+// list; Returns the commands c may see, sorted by name.
+func (cm *CommandManager) list(c *Client) []*Command {
+	var list []*Command
+	for _, command := range cm.commands {
+		if !command.Moderator || isModerator(c) {
+			list = append(list, command)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// reply; Answers a command privately, shown to c as a notice.
+func reply(c *Client, text string) {
+	sendEvent(c, "notice", NoticeData{Text: text})
+}
+
+// cutArg; Splits the first argument off args. An argument in double quotes
+// may contain spaces, for nicks that do.
+func cutArg(args string) (string, string) {
+	args = strings.TrimSpace(args)
+	if strings.HasPrefix(args, `"`) {
+		if arg, rest, ok := strings.Cut(args[1:], `"`); ok {
+			return arg, strings.TrimSpace(rest)
+		}
+	}
+	arg, rest, _ := strings.Cut(args, " ")
+	return arg, strings.TrimSpace(rest)
+}
+
+// cutDuration; Splits a leading duration such as 10m off args, if there is one.
+func cutDuration(args string) (string, string) {
+	arg, rest := cutArg(args)
+	if _, err := time.ParseDuration(arg); err == nil {
+		return arg, rest
+	}
+	return "", args
+}
+
+// emitAs; Runs the handler of event for c, as if c sent it with data.
+func emitAs(events *EventManager, c *Client, event string, data interface{}) error {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	events.Emit(event, c, dataJSON)
+	return nil
+}
+
+// registerCommands; Registers the built-in commands. Moderation commands go
+// through the events of the same name, so the checks are the same.
+func registerCommands(commands *CommandManager, events *EventManager) {
+	commands.On(Command{
+		Name:  "help",
+		Usage: "[command]",
+		Help:  "Lists the commands, or explains one.",
+		Handler: func(c *Client, args string) error {
+			if args != "" {
+				command, found := commands.commands[strings.ToLower(strings.TrimPrefix(args, "/"))]
+				if !found || (command.Moderator && !isModerator(c)) {
+					return fmt.Errorf("Unknown command /%s.", strings.TrimPrefix(args, "/"))
+				}
+				reply(c, command.String())
+				return nil
+			}
+
+			var lines []string
+			for _, command := range commands.list(c) {
+				lines = append(lines, command.String())
+			}
+			reply(c, "Commands:\n"+strings.Join(lines, "\n")+"\nStart a message with // to send a literal /.")
+			return nil
+		},
+	})
+
+	commands.On(Command{
+		Name:  "me",
+		Usage: "<action>",
+		Help:  "Sends an action, shown as * nick action.",
+		Handler: func(c *Client, args string) error {
+			if args == "" {
+				return errors.New("Usage: /me <action>")
+			}
+			postMessage(c, MessageData{M: Message{Text: args}, Action: true})
+			return nil
+		},
+	})
+
+	commands.On(Command{
+		Name:  "who",
+		Usage: "[room]",
+		Help:  "Lists who is in this room, or another one.",
+		Handler: func(c *Client, args string) error {
+			hub := c.hub()
+			if args != "" {
+				name, ok := normalizeRoomName(args)
+				if !ok {
+					return fmt.Errorf("No such room %q.", args)
+				}
+				found := false
+				for _, h := range rooms.all() {
+					if h.name == name {
+						hub, found = h, true
+					}
+				}
+				if !found {
+					return fmt.Errorf("No such room %q.", args)
+				}
+			}
+
+			users := hub.userList()
+			sort.Strings(users)
+			reply(c, fmt.Sprintf("%d in %s: %s", len(users), hub.name, strings.Join(users, ", ")))
+			return nil
+		},
+	})
+
+	commands.On(Command{
+		Name:  "msg",
+		Usage: "<nick> <message>",
+		Help:  "Sends a direct message.",
+		Handler: func(c *Client, args string) error {
+			nick, text := cutArg(args)
+			if nick == "" || text == "" {
+				return errors.New("Usage: /msg <nick> <message>")
+			}
+			// match the nick the way it is in chat.
+			for _, hub := range rooms.all() {
+				for _, user := range hub.userList() {
+					if sameNick(user, nick) {
+						nick = user
+					}
+				}
+			}
+			return emitAs(events, c, "send-dm", MessageData{To: nick, M: Message{Text: text}})
+		},
+	})
+
+	commands.On(Command{
+		Name:  "nick",
+		Usage: "<nick>",
+		Help:  "Changes your nick.",
+		Handler: func(c *Client, args string) error {
+			if args == "" {
+				return errors.New("Usage: /nick <nick>")
+			}
+			return emitAs(events, c, "change-nick", EventData{Nick: args})
+		},
+	})
+
+	for _, state := range []string{presenceAway, presenceBusy} {
+		state := state
+		commands.On(Command{
+			Name:  state,
+			Usage: "[status]",
+			Help:  "Shows you as " + state + ", with an optional status.",
+			Handler: func(c *Client, args string) error {
+				return emitAs(events, c, "set-presence", PresenceRequest{State: state, Status: args})
+			},
+		})
+	}
+
+	commands.On(Command{
+		Name:  "back",
+		Usage: "[status]",
+		Help:  "Shows you as online again.",
+		Handler: func(c *Client, args string) error {
+			return emitAs(events, c, "set-presence", PresenceRequest{State: presenceOnline, Status: args})
+		},
+	})
+
+	commands.On(Command{
+		Name:  "topic",
+		Usage: "[topic|-]",
+		Help:  "Shows the topic of this room, sets it, or clears it with -.",
+		Handler: func(c *Client, args string) error {
+			switch args {
+			case "":
+				topic := topics.topic(c.hub().name)
+				if topic == nil {
+					reply(c, "No topic is set in "+c.hub().name+".")
+					return nil
+				}
+				reply(c, fmt.Sprintf("Topic of %s, set by %s on %s: %s", c.hub().name, topic.By, topic.Set.Format("2006-01-02 15:04 MST"), topic.Text))
+				return nil
+			case "-":
+				args = ""
+			}
+			return emitAs(events, c, "set-topic", Topic{Text: args})
+		},
+	})
+
+	commands.On(Command{
+		Name:  "join",
+		Usage: "<room>",
+		Help:  "Moves you to another room, it is made if it does not exist.",
+		Handler: func(c *Client, args string) error {
+			if args == "" {
+				return errors.New("Usage: /join <room>")
+			}
+			return emitAs(events, c, "join-room", EventData{Room: args})
+		},
+	})
+
+	commands.On(Command{
+		Name: "leave",
+		Help: "Goes back to the " + defaultRoom + ".",
+		Handler: func(c *Client, args string) error {
+			return emitAs(events, c, "leave-room", nil)
+		},
+	})
+
+	commands.On(Command{
+		Name:      "kick",
+		Usage:     "<nick> [reason]",
+		Help:      "Throws a nick out, it may come back.",
+		Moderator: true,
+		Handler: func(c *Client, args string) error {
+			nick, reason := cutArg(args)
+			if nick == "" {
+				return errors.New("Usage: /kick <nick> [reason]")
+			}
+			return emitAs(events, c, "kick", ModerationRequest{Nick: nick, Reason: reason})
+		},
+	})
+
+	commands.On(Command{
+		Name:      "ban",
+		Usage:     "<nick|ip|range> [duration] [reason]",
+		Help:      "Bans a nick and its IPs, or an IP or CIDR range. Forever without a duration.",
+		Moderator: true,
+		Handler: func(c *Client, args string) error {
+			target, rest := cutArg(args)
+			if target == "" {
+				return errors.New("Usage: /ban <nick|ip|range> [duration] [reason]")
+			}
+			duration, reason := cutDuration(rest)
+			req := ModerationRequest{Duration: duration, Reason: reason}
+			if isIPOrRange(target) {
+				req.IP = target
+			} else {
+				req.Nick = target
+			}
+			return emitAs(events, c, "ban", req)
+		},
+	})
+
+	commands.On(Command{
+		Name:      "unban",
+		Usage:     "<nick|ip|range>",
+		Help:      "Lifts a ban.",
+		Moderator: true,
+		Handler: func(c *Client, args string) error {
+			target, _ := cutArg(args)
+			if target == "" {
+				return errors.New("Usage: /unban <nick|ip|range>")
+			}
+			if isIPOrRange(target) {
+				return emitAs(events, c, "unban", ModerationRequest{IP: target})
+			}
+			return emitAs(events, c, "unban", ModerationRequest{Nick: target})
+		},
+	})
+
+	commands.On(Command{
+		Name:      "mute",
+		Usage:     "<nick> [duration] [reason]",
+		Help:      "Keeps a nick from sending messages, for " + muteTime.String() + " without a duration.",
+		Moderator: true,
+		Handler: func(c *Client, args string) error {
+			nick, rest := cutArg(args)
+			if nick == "" {
+				return errors.New("Usage: /mute <nick> [duration] [reason]")
+			}
+			duration, reason := cutDuration(rest)
+			return emitAs(events, c, "mute", ModerationRequest{Nick: nick, Duration: duration, Reason: reason})
+		},
+	})
+
+	commands.On(Command{
+		Name:      "unmute",
+		Usage:     "<nick>",
+		Help:      "Lifts a mute.",
+		Moderator: true,
+		Handler: func(c *Client, args string) error {
+			nick, _ := cutArg(args)
+			if nick == "" {
+				return errors.New("Usage: /unmute <nick>")
+			}
+			return emitAs(events, c, "unmute", ModerationRequest{Nick: nick})
+		},
+	})
+}
+
+// isIPOrRange; Returns true if s is an IP or CIDR range rather than a nick.
+func isIPOrRange(s string) bool {
+	if _, err := netip.ParsePrefix(s); err == nil {
+		return true
+	}
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
@@ -0,0 +1,305 @@
+// File: config.go - Configuration file and environment variables
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Every flag can also be set in the -config file or the environment, a
+//    flag wins over the environment, which wins over the file.
+//  - The file is a JSON object, or key = value lines, keyed by flag name.
+//  - Environment variables are CHAT_ and the flag name in upper case, e.g.
+//    CHAT_CACHE. A .env file in the working directory is read into the
+//    environment, variables already set win.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var configFile = flag.String("config", "", "Configuration file, a JSON object or key = value lines of flag names. Also CHAT_CONFIG.")
+var command = flag.String("command", ".command", "File with the command that prints TURN credentials, see WebRTC Signaling.")
+
+// envAliases are the environment variables documented before CHAT_<FLAG>,
+// they are still read.
+var envAliases = map[string]string{
+	"CACHE_SIZE":             "cache",
+	"CHAT_SIGNALING_ENABLED": "signaling",
+}
+
+// boolWords are more spellings of true and false for switches such as
+// -signaling, setups from before CHAT_<FLAG> use CHAT_SIGNALING_ENABLED=yes.
+var boolWords = map[string]string{
+	"yes": "true", "y": "true", "on": "true", "enabled": "true",
+	"no": "false", "n": "false", "off": "false", "disabled": "false",
+}
+
+// envName; Returns the environment variable of a flag.
+func envName(name string) string {
+	return "CHAT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// commandLine are the flags given on the command line, nothing overrides
+// them, not even a reload.
+var commandLine = make(map[string]bool)
+
+// setting is a flag value from the config file or the environment.
+type setting struct {
+	value  string
+	source string // file or variable it came from.
+}
+
+// loadConfig; Sets the flags not given on the command line from the config
+// file, then the environment. Call after flag.Parse.
+func loadConfig() error {
+	flag.Visit(func(f *flag.Flag) { commandLine[f.Name] = true })
+
+	settings, err := readSettings()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := settings[name]
+		if err := flag.Set(name, s.value); err != nil {
+			return fmt.Errorf("%s: invalid %s %q: %v", s.source, name, s.value, err)
+		}
+		logger("DEBUG", "Set", name, "from", s.source)
+	}
+	return nil
+}
+
+// readSettings; Returns the flag values of the config file and the
+// environment, the environment wins. Flags given on the command line are
+// left out.
+func readSettings() (map[string]setting, error) {
+	if err := loadDotEnv(".env"); err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]setting)
+	path := *configFile
+	if env := os.Getenv(envName("config")); env != "" && !commandLine["config"] {
+		path = env
+	}
+	if path != "" {
+		file, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range file {
+			if name == "config" {
+				return nil, fmt.Errorf("%s: config can't be set in the config file", path)
+			}
+			if flag.Lookup(name) == nil {
+				return nil, fmt.Errorf("%s: unknown setting %q", path, name)
+			}
+			if !commandLine[name] {
+				settings[name] = setting{value: value, source: path}
+			}
+		}
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if commandLine[f.Name] || f.Name == "config" {
+			return
+		}
+		env := envName(f.Name)
+		value := os.Getenv(env)
+		if value == "" {
+			for alias, name := range envAliases {
+				if name == f.Name && os.Getenv(alias) != "" {
+					env, value = alias, os.Getenv(alias)
+				}
+			}
+		}
+		// empty variables are unset, containers often pass them.
+		if value != "" {
+			settings[f.Name] = setting{value: value, source: env}
+		}
+	})
+
+	for name, s := range settings {
+		if isBoolFlag(name) {
+			if word, ok := boolWords[strings.ToLower(s.value)]; ok {
+				s.value = word
+				settings[name] = s
+			}
+		}
+	}
+	return settings, nil
+}
+
+// isBoolFlag; Returns true if the flag is a switch, given without a value on
+// the command line.
+func isBoolFlag(name string) bool {
+	f := flag.Lookup(name)
+	if f == nil {
+		return false
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// readConfigFile; Reads the settings of a config file, flag name -> value.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return parseKeyValues(path, data)
+	}
+
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	settings := make(map[string]string, len(file))
+	for name, raw := range file {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+		switch v := value.(type) {
+		case string:
+			settings[strings.ToLower(name)] = v
+		case json.Number, bool:
+			settings[strings.ToLower(name)] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string, number or boolean", path, name)
+		}
+	}
+	return settings, nil
+}
+
+// parseKeyValues; Parses key = value lines. Blank lines and lines starting
+// with # are skipped, values may be quoted.
+func parseKeyValues(path string, data []byte) (map[string]string, error) {
+	settings := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("%s:%d: sections are not supported", path, i+1)
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, i+1)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch {
+		case strings.HasPrefix(value, `"`):
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: bad quoted value", path, i+1, key)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) >= 2:
+			value = value[1 : len(value)-1]
+		default:
+			// a comment may follow an unquoted value.
+			if before, _, found := strings.Cut(value, " #"); found {
+				value = strings.TrimSpace(before)
+			}
+		}
+		settings[key] = value
+	}
+	return settings, nil
+}
+
+// dotEnv are the environment variables set from .env.
+var dotEnv = make(map[string]bool)
+
+// loadDotEnv; Reads a .env file into the environment, a missing file is fine.
+func loadDotEnv(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	vars, err := parseKeyValues(path, data)
+	if err != nil {
+		return err
+	}
+
+	// a reload may change or drop what the file set before.
+	for key := range dotEnv {
+		if _, ok := vars[strings.ToLower(key)]; !ok {
+			os.Unsetenv(key)
+			delete(dotEnv, key)
+		}
+	}
+	for key, value := range vars {
+		key = strings.ToUpper(key)
+		if _, set := os.LookupEnv(key); !set || dotEnv[key] {
+			os.Setenv(key, value)
+			dotEnv[key] = true
+		}
+	}
+	return nil
+}
+
+// dataFile; Returns path, or the file name in -datadir if path is empty.
+func dataFile(path string, name string) string {
+	if path == "" {
+		return filepath.Join(*dataDir, name)
+	}
+	return path
+}
+
+// validateConfig; Checks the settings that can be checked before anything
+// starts, so a bad one stops the server with a clear message.
+func validateConfig() error {
+	var errs []error
+	check := func(ok bool, format string, v ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, v...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(*address)
+	check(err == nil, "bind: %q is not host:port", *address)
+	_, ok := logLevels[strings.ToUpper(*logLevel)]
+	check(ok, "log: %q is not DEBUG, INFO or ERROR", *logLevel)
+	check(*cache >= 0, "cache: can't be negative")
+	check(*maxMessageSize > 0, "readlimit: must be at least 1")
+	check(*maxUploadSize > 0, "uploadlimit: must be at least 1")
+	check((*certFile == "") == (*keyFile == ""), "certfile and keyfile: set both or neither")
+	for name, path := range map[string]*string{"certfile": certFile, "keyfile": keyFile} {
+		if *path != "" {
+			_, err := os.Stat(*path)
+			check(err == nil, "%s: %v", name, err)
+		}
+	}
+	if *command != ".command" {
+		_, err := os.Stat(*command)
+		check(err == nil, "command: %v", err)
+	}
+	check(*storeKind == "memory" || *storeKind == "disk", "store: %q is not memory or disk", *storeKind)
+	check(*historyRetain >= 0, "retain: can't be negative")
+	check(*rateKick >= 0, "ratekick: can't be negative")
+	check(*muteTime > 0, "mutetime: must be more than 0")
+	check(*resumeGrace >= 0, "resumegrace: can't be negative")
+	check(*idleTime >= 0, "idletime: can't be negative")
+	check(*nickMin >= 1 && *nickMax >= *nickMin, "nickmin/nickmax: need 1 <= nickmin <= nickmax")
+	return errors.Join(errs...)
+}
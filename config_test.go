@@ -0,0 +1,224 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	data := []byte(`
+# comment
+bind = ":8090"
+Cache=50
+export STORE = disk
+motd = /etc/motd # the message of the day
+status = 'single # quoted'
+pattern = "^[a-z]+\\d$"
+empty =
+`)
+	got, err := parseKeyValues("chat.conf", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"bind":    ":8090",
+		"cache":   "50",
+		"store":   "disk",
+		"motd":    "/etc/motd",
+		"status":  "single # quoted",
+		"pattern": `^[a-z]+\d$`,
+		"empty":   "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseKeyValues = %#v, want %#v", got, want)
+	}
+
+	for _, bad := range []string{"[section]", "no equals sign", `key = "unterminated`} {
+		if _, err := parseKeyValues("chat.conf", []byte(bad)); err == nil {
+			t.Errorf("parseKeyValues(%q) accepted it", bad)
+		}
+	}
+}
+
+func TestReadConfigFileJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.json")
+	os.WriteFile(path, []byte(`{"cache": 50, "signaling": true, "Log": "DEBUG", "mutetime": "5m", "retain": 1e3}`), 0o644)
+	got, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"cache": "50", "signaling": "true", "log": "DEBUG", "mutetime": "5m", "retain": "1e3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readConfigFile = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{`{"cache": [1]}`, `{"cache": {"a": 1}}`, `{"cache": null}`, `{"cache": 5`} {
+		os.WriteFile(path, []byte(bad), 0o644)
+		if _, err := readConfigFile(path); err == nil {
+			t.Errorf("readConfigFile(%s) accepted it", bad)
+		}
+	}
+}
+
+// inDir; Runs the test in dir, .env is read from the working directory.
+func inDir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// drops what .env put into the environment.
+		loadDotEnv(filepath.Join(dir, "missing"))
+		os.Chdir(wd)
+	})
+}
+
+// onCommandLine; Treats the flags as given on the command line for the test.
+func onCommandLine(t *testing.T, names ...string) {
+	old := commandLine
+	commandLine = make(map[string]bool)
+	for _, name := range names {
+		commandLine[name] = true
+	}
+	t.Cleanup(func() { commandLine = old })
+}
+
+func values(settings map[string]setting) map[string]string {
+	got := make(map[string]string)
+	for name, s := range settings {
+		got[name] = s.value
+	}
+	return got
+}
+
+func TestReadSettingsPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir)
+	onCommandLine(t, "motd")
+
+	path := filepath.Join(dir, "chat.conf")
+	os.WriteFile(path, []byte("cache = 5\nlog = DEBUG\nmotd = from-file\nnickmax = 20\nstore = disk\n"), 0o644)
+	os.WriteFile(".env", []byte("CHAT_NICKMAX=10\nCHAT_IDLETIME=1m\n"), 0o644)
+	t.Setenv("CHAT_CONFIG", path)
+	t.Setenv("CHAT_LOG", "ERROR")
+	t.Setenv("CHAT_NICKMAX", "30")
+	t.Setenv("CHAT_STORE", "")
+	t.Setenv("CHAT_MOTD", "from-env")
+
+	settings, err := readSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := values(settings)
+	want := map[string]string{
+		"cache":    "5",     // file.
+		"log":      "ERROR", // the environment wins over the file.
+		"nickmax":  "30",    // set variables win over .env.
+		"idletime": "1m",    // .env.
+		"store":    "disk",  // empty variables are unset.
+		// motd is on the command line, nothing overrides it.
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %q from %s, want %q", name, got[name], settings[name].source, value)
+		}
+	}
+	if _, ok := got["motd"]; ok {
+		t.Errorf("motd = %q, the command line must win", got["motd"])
+	}
+	if settings["log"].source != "CHAT_LOG" || settings["cache"].source != path {
+		t.Errorf("sources %q and %q", settings["log"].source, settings["cache"].source)
+	}
+}
+
+func TestReadSettingsAliases(t *testing.T) {
+	inDir(t, t.TempDir())
+	onCommandLine(t)
+	t.Setenv("CHAT_CONFIG", "")
+	t.Setenv("CACHE_SIZE", "7")
+	t.Setenv("CHAT_SIGNALING_ENABLED", "true")
+	t.Setenv("CHAT_SIGNALING", "false")
+
+	settings, err := readSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := settings["cache"]; got.value != "7" || got.source != "CACHE_SIZE" {
+		t.Errorf("cache = %+v, want 7 from CACHE_SIZE", got)
+	}
+	// the documented name wins over the old one.
+	if got := settings["signaling"]; got.value != "false" {
+		t.Errorf("signaling = %+v, want false from CHAT_SIGNALING", got)
+	}
+}
+
+func TestReadSettingsBoolWords(t *testing.T) {
+	inDir(t, t.TempDir())
+	onCommandLine(t)
+	t.Setenv("CHAT_CONFIG", "")
+	t.Setenv("CHAT_TOPICMODS", "off")
+	t.Setenv("CHAT_SIGNALING_ENABLED", "Yes")
+	t.Setenv("CHAT_NICKPATTERN", "yes")
+
+	settings, err := readSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"signaling": "true", "topicmods": "false", "nickpattern": "yes"}
+	for name, value := range want {
+		if got := settings[name].value; got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestReadSettingsErrors(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir)
+	onCommandLine(t)
+	path := filepath.Join(dir, "chat.conf")
+	t.Setenv("CHAT_CONFIG", path)
+
+	for _, content := range []string{"nosuchflag = 1", "config = other.conf", "{not json"} {
+		os.WriteFile(path, []byte(content), 0o644)
+		if _, err := readSettings(); err == nil {
+			t.Errorf("config file %q accepted", content)
+		}
+	}
+
+	os.Remove(path)
+	if _, err := readSettings(); err == nil {
+		t.Error("missing config file accepted")
+	}
+}
+
+func TestLoadDotEnvReload(t *testing.T) {
+	dir := t.TempDir()
+	inDir(t, dir)
+	t.Setenv("CHAT_TEST_KEEP", "outside")
+
+	os.WriteFile(".env", []byte("CHAT_TEST_A=1\nCHAT_TEST_KEEP=dotenv\n"), 0o644)
+	if err := loadDotEnv(".env"); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("CHAT_TEST_A") != "1" || os.Getenv("CHAT_TEST_KEEP") != "outside" {
+		t.Fatalf("after loading A=%q KEEP=%q", os.Getenv("CHAT_TEST_A"), os.Getenv("CHAT_TEST_KEEP"))
+	}
+
+	// a reload changes and drops what .env set, and only that.
+	os.WriteFile(".env", []byte("CHAT_TEST_B=2\n"), 0o644)
+	if err := loadDotEnv(".env"); err != nil {
+		t.Fatal(err)
+	}
+	if _, set := os.LookupEnv("CHAT_TEST_A"); set {
+		t.Error("CHAT_TEST_A is still set after it left .env")
+	}
+	if os.Getenv("CHAT_TEST_B") != "2" || os.Getenv("CHAT_TEST_KEEP") != "outside" {
+		t.Errorf("after reloading B=%q KEEP=%q", os.Getenv("CHAT_TEST_B"), os.Getenv("CHAT_TEST_KEEP"))
+	}
+}
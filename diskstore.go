@@ -0,0 +1,567 @@
+// File: diskstore.go - Append-only on-disk message history
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Every room gets a directory of numbered JSON-lines segment files.
+//  - Each line is a record, later records for the same id replace earlier ones.
+//  - segments.json lists the live segments of a room. Compaction rewrites the
+//    live messages into fresh segments once most records on disk are dead and
+//    commits by replacing the list, segments it doesn't list are left over
+//    from an interrupted compaction and removed on load.
+//  - The message id counter is reserved in blocks, so ids never repeat.
+//  - At most loadedRooms rooms are kept in memory, a segment file is only
+//    open while its room is loaded and has been written to.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Records written to a segment before starting the next one.
+	segmentRecords = 1000
+
+	// Message ids reserved per write of the counter file.
+	idReserve = 100
+
+	// Rooms kept in memory, the least recently used one is closed to load
+	// another.
+	loadedRooms = 64
+
+	// Lists the live segments of a room.
+	manifestName = "segments.json"
+)
+
+type historyRecord struct {
+	Op  string      `json:"op"`
+	Msg MessageData `json:"msg"`
+}
+
+type diskStore struct {
+	mu       sync.Mutex
+	dir      string
+	msgid    int64
+	reserved int64
+	rooms    map[string]*diskRoom
+	uses     int64 // counts room lookups, see diskRoom.used.
+}
+
+type diskRoom struct {
+	dir      string
+	msgs     []MessageData  // live messages, oldest first.
+	index    map[string]int // message id -> position in msgs plus dropped.
+	dropped  int            // messages trimmed off the front of msgs.
+	segments []int          // segment numbers, ascending.
+	file     *os.File       // last segment, opened for appending on first write.
+	records  int            // records in the last segment.
+	total    int            // records in all segments.
+	used     int64          // diskStore.uses when the room was last looked up.
+}
+
+func openDiskStore(dir string) (*diskStore, error) {
+	s := &diskStore{
+		dir:   filepath.Join(dir, "history"),
+		rooms: make(map[string]*diskRoom),
+	}
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating history directory: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "msgid"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading message id counter: %v", err)
+	}
+	if len(data) > 0 {
+		s.reserved, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing message id counter: %v", err)
+		}
+		// ids up to the last reservation may have been handed out.
+		s.msgid = s.reserved
+	}
+	logger("INFO", "History stored in", s.dir, "next message id", s.msgid+1)
+	return s, nil
+}
+
+func (s *diskStore) NextID() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.msgid >= s.reserved {
+		reserved := s.msgid + idReserve
+		err := writeFileAtomic(filepath.Join(s.dir, "msgid"), []byte(strconv.FormatInt(reserved, 10)))
+		if err != nil {
+			return "", fmt.Errorf("error saving message id counter: %v", err)
+		}
+		s.reserved = reserved
+	}
+	s.msgid++
+	return formatMessageID(s.msgid), nil
+}
+
+func (s *diskStore) Append(room string, msg MessageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.room(room)
+	if err != nil {
+		return err
+	}
+	return r.write(historyRecord{Op: "add", Msg: msg})
+}
+
+func (s *diskStore) Recent(room string, n int) ([]MessageData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.room(room)
+	if err != nil {
+		return nil, err
+	}
+	return tail(r.msgs, n), nil
+}
+
+func (s *diskStore) Before(room string, before string, limit int) ([]MessageData, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.room(room)
+	if err != nil {
+		return nil, false, err
+	}
+	msgs, more := page(r.msgs, before, limit)
+	return msgs, more, nil
+}
+
+func (s *diskStore) Get(room string, id string) (MessageData, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.room(room)
+	if err != nil {
+		return MessageData{}, false, err
+	}
+	msg, ok := r.get(id)
+	return msg, ok, nil
+}
+
+func (s *diskStore) Replies(room string, id string) ([]MessageData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.room(room)
+	if err != nil {
+		return nil, err
+	}
+	return replies(r.msgs, id), nil
+}
+
+func (s *diskStore) Update(room string, msg MessageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, err := s.room(room)
+	if err != nil {
+		return err
+	}
+	if _, ok := r.get(msg.ID); !ok {
+		return nil
+	}
+	return r.write(historyRecord{Op: "update", Msg: msg})
+}
+
+// Each; loads every room found on disk.
+func (s *diskStore) Each(fn func(room string, msg MessageData)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("error listing history: %v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		r, err := s.room(entry.Name())
+		if err != nil {
+			return err
+		}
+		for _, msg := range r.msgs {
+			fn(entry.Name(), msg)
+		}
+	}
+	return nil
+}
+
+func (s *diskStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for _, r := range s.rooms {
+		if err := r.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// room; Returns the loaded room, reading its segments on first use.
+func (s *diskStore) room(name string) (*diskRoom, error) {
+	s.uses++
+	if r, ok := s.rooms[name]; ok {
+		r.used = s.uses
+		return r, nil
+	}
+
+	r := &diskRoom{
+		dir:   filepath.Join(s.dir, name),
+		index: make(map[string]int),
+	}
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating room history directory: %v", err)
+	}
+
+	segments, err := r.liveSegments()
+	if err != nil {
+		return nil, err
+	}
+	r.segments = segments
+
+	for _, seq := range r.segments {
+		records, err := r.load(seq)
+		if err != nil {
+			return nil, err
+		}
+		r.records = records
+	}
+	r.trim()
+
+	if len(r.segments) == 0 {
+		r.segments = []int{1}
+		r.records = 0
+		if err := r.writeManifest(r.segments); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.maybeCompact(); err != nil {
+		return nil, err
+	}
+
+	if len(s.rooms) >= loadedRooms {
+		s.unloadLeastUsed()
+	}
+	logger("DEBUG", "Loaded", len(r.msgs), "messages for room", name, "from", len(r.segments), "segments")
+	r.used = s.uses
+	s.rooms[name] = r
+	return r, nil
+}
+
+// unloadLeastUsed; Closes the room looked up least recently, it is read from
+// disk again when needed.
+func (s *diskStore) unloadLeastUsed() {
+	var oldest string
+	for name, r := range s.rooms {
+		if oldest == "" || r.used < s.rooms[oldest].used {
+			oldest = name
+		}
+	}
+	if err := s.rooms[oldest].close(); err != nil {
+		logger("ERROR", "Failed to close history of", oldest+":", err)
+	}
+	delete(s.rooms, oldest)
+	logger("DEBUG", "Unloaded history of room", oldest)
+}
+
+// segmentNumber; Parses a segment file name such as 00000001.jsonl.
+func segmentNumber(name string) (int, bool) {
+	if !strings.HasSuffix(name, ".jsonl") {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(strings.TrimSuffix(name, ".jsonl"))
+	return seq, err == nil
+}
+
+func (r *diskRoom) segmentPath(seq int) string {
+	return filepath.Join(r.dir, fmt.Sprintf("%08d.jsonl", seq))
+}
+
+// liveSegments; Returns the segments listed in the manifest and removes the
+// others, they are left over from an interrupted compaction. A room without
+// a manifest uses every segment and gets one.
+func (r *diskRoom) liveSegments() ([]int, error) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing room history: %v", err)
+	}
+	var onDisk []int
+	for _, entry := range entries {
+		if seq, ok := segmentNumber(entry.Name()); ok {
+			onDisk = append(onDisk, seq)
+		}
+	}
+	sort.Ints(onDisk)
+
+	data, err := os.ReadFile(filepath.Join(r.dir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		if len(onDisk) > 0 {
+			if err := r.writeManifest(onDisk); err != nil {
+				return nil, err
+			}
+		}
+		// an empty room gets its manifest from room.
+		return onDisk, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading history manifest: %v", err)
+	}
+	var segments []int
+	if err := json.Unmarshal(data, &segments); err != nil {
+		return nil, fmt.Errorf("error reading history manifest: %v", err)
+	}
+	sort.Ints(segments)
+
+	for _, seq := range onDisk {
+		i := sort.SearchInts(segments, seq)
+		if i < len(segments) && segments[i] == seq {
+			continue
+		}
+		logger("INFO", "Removing leftover history segment", r.segmentPath(seq))
+		if err := os.Remove(r.segmentPath(seq)); err != nil {
+			logger("ERROR", "Failed to remove leftover segment:", err)
+		}
+	}
+	return segments, nil
+}
+
+// writeManifest; Replaces the list of live segments.
+func (r *diskRoom) writeManifest(segments []int) error {
+	data, err := json.Marshal(segments)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(r.dir, manifestName), data); err != nil {
+		return fmt.Errorf("error writing history manifest: %v", err)
+	}
+	return nil
+}
+
+// load; Applies every record of a segment, returns how many were read. A last
+// line without its newline is a write cut short by a crash, it is cut off the
+// file so the next record starts on a line of its own.
+func (r *diskRoom) load(seq int) (int, error) {
+	path := r.segmentPath(seq)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// listed when it was started, nothing was written to it.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error opening history segment: %v", err)
+	}
+	defer f.Close()
+
+	records := 0
+	var size int64 // bytes of complete lines.
+	reader := bufio.NewReaderSize(f, 64*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) == 0 {
+				break
+			}
+			logger("ERROR", "Cutting off incomplete record at the end of", path)
+			f.Close()
+			if err := os.Truncate(path, size); err != nil {
+				return 0, fmt.Errorf("error truncating history segment: %v", err)
+			}
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error reading history segment: %v", err)
+		}
+		size += int64(len(line))
+
+		var record historyRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			logger("ERROR", "Skipping bad record in", path+":", err)
+			continue
+		}
+		r.apply(record)
+		records++
+		r.total++
+	}
+	return records, nil
+}
+
+// get; Returns the live message with the given id.
+func (r *diskRoom) get(id string) (MessageData, bool) {
+	i, ok := r.index[id]
+	if !ok {
+		return MessageData{}, false
+	}
+	return r.msgs[i-r.dropped], true
+}
+
+// apply; Applies a record to the in-memory view of the room.
+func (r *diskRoom) apply(record historyRecord) {
+	if i, ok := r.index[record.Msg.ID]; ok {
+		r.msgs[i-r.dropped] = record.Msg
+		return
+	}
+	if record.Op == "add" {
+		r.index[record.Msg.ID] = r.dropped + len(r.msgs)
+		r.msgs = append(r.msgs, record.Msg)
+	}
+}
+
+// trim; Drops the oldest messages over the -retain limit. Positions in index
+// count the dropped ones too, so the others don't move.
+func (r *diskRoom) trim() {
+	if *historyRetain <= 0 {
+		return
+	}
+	excess := len(r.msgs) - max(*historyRetain, int(cacheSize.Load()))
+	if excess <= 0 {
+		return
+	}
+	for _, msg := range r.msgs[:excess] {
+		delete(r.index, msg.ID)
+	}
+	r.msgs = r.msgs[excess:]
+	r.dropped += excess
+}
+
+// openLast; Opens the last segment for appending.
+func (r *diskRoom) openLast() error {
+	f, err := os.OpenFile(r.segmentPath(r.segments[len(r.segments)-1]), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("error opening history segment: %v", err)
+	}
+	r.file = f
+	return nil
+}
+
+// write; Appends a record to the last segment and applies it.
+func (r *diskRoom) write(record historyRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error encoding history record: %v", err)
+	}
+	if r.file == nil {
+		if err := r.openLast(); err != nil {
+			return err
+		}
+	}
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing history record: %v", err)
+	}
+	r.records++
+	r.total++
+	r.apply(record)
+	r.trim()
+
+	if r.records >= segmentRecords {
+		// listed before it is written to, or a reload would skip it.
+		segments := append(append([]int{}, r.segments...), r.segments[len(r.segments)-1]+1)
+		if err := r.writeManifest(segments); err != nil {
+			return err
+		}
+		if err := r.close(); err != nil {
+			return err
+		}
+		r.segments = segments
+		r.records = 0
+	}
+	return r.maybeCompact()
+}
+
+// maybeCompact; Compacts once dead records outnumber the live messages.
+func (r *diskRoom) maybeCompact() error {
+	dead := r.total - len(r.msgs)
+	if dead < segmentRecords || dead <= len(r.msgs) {
+		return nil
+	}
+	return r.compact()
+}
+
+// compact; Writes the live messages into new segments, lists them in the
+// manifest and removes the old ones. A crash before the manifest is replaced
+// loads the old segments, after it the new ones.
+func (r *diskRoom) compact() error {
+	if err := r.close(); err != nil {
+		return err
+	}
+
+	old := r.segments
+	next := old[len(old)-1] + 1
+	var segments []int
+	records := 0
+	for start := 0; start < len(r.msgs) || len(segments) == 0; start += segmentRecords {
+		end := min(start+segmentRecords, len(r.msgs))
+		if err := r.writeSegment(next, r.msgs[start:end]); err != nil {
+			return err
+		}
+		segments = append(segments, next)
+		records = end - start
+		next++
+	}
+
+	if err := r.writeManifest(segments); err != nil {
+		for _, seq := range segments {
+			os.Remove(r.segmentPath(seq))
+		}
+		return err
+	}
+	for _, seq := range old {
+		if err := os.Remove(r.segmentPath(seq)); err != nil {
+			logger("ERROR", "Failed to remove compacted segment:", err)
+		}
+	}
+
+	logger("INFO", "Compacted history of", filepath.Base(r.dir)+":", r.total, "records down to", len(r.msgs))
+	r.segments = segments
+	r.records = records
+	r.total = len(r.msgs)
+	return nil
+}
+
+func (r *diskRoom) writeSegment(seq int, msgs []MessageData) error {
+	f, err := os.Create(r.segmentPath(seq))
+	if err != nil {
+		return fmt.Errorf("error creating history segment: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, msg := range msgs {
+		if err := encoder.Encode(historyRecord{Op: "add", Msg: msg}); err != nil {
+			f.Close()
+			return fmt.Errorf("error writing history segment: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing history segment: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("error syncing history segment: %v", err)
+	}
+	return f.Close()
+}
+
+func (r *diskRoom) close() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Sync()
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	r.file = nil
+	return err
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// openTestStore; Opens a disk store in dir, it is closed after the test.
+func openTestStore(t *testing.T, dir string) *diskStore {
+	t.Helper()
+	s, err := openDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// post; Appends a message with a new id, returns the id.
+func post(t *testing.T, s HistoryStore, room string, text string) string {
+	t.Helper()
+	id, err := s.NextID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Append(room, MessageData{ID: id, M: Message{Text: text}}); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func texts(t *testing.T, s HistoryStore, room string) []string {
+	t.Helper()
+	msgs, err := s.Recent(room, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := []string{}
+	for _, msg := range msgs {
+		list = append(list, msg.M.Text)
+	}
+	return list
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	setFlag(t, historyRetain, 0)
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	post(t, s, "lobby", "one")
+	id := post(t, s, "lobby", "two")
+	post(t, s, "other", "three")
+	if err := s.Update("lobby", MessageData{ID: id, M: Message{Text: "two, edited"}, Edited: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, dir)
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, []string{"one", "two, edited"}) {
+		t.Errorf("lobby after reopening = %v", got)
+	}
+	if got := texts(t, s, "other"); !reflect.DeepEqual(got, []string{"three"}) {
+		t.Errorf("other after reopening = %v", got)
+	}
+	next, _ := s.NextID()
+	if parseMessageID(next) <= parseMessageID(id) {
+		t.Errorf("id %s after reopening repeats an earlier one, last was %s", next, id)
+	}
+}
+
+func TestDiskRoomTornRecord(t *testing.T) {
+	setFlag(t, historyRetain, 0)
+	dir := t.TempDir()
+	room := filepath.Join(dir, "history", "lobby")
+	if err := os.MkdirAll(room, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	segment := filepath.Join(room, "00000001.jsonl")
+	good := `{"op":"add","msg":{"f":"a","id":"msg_1000","m":{"text":"kept"}}}` + "\n"
+	if err := os.WriteFile(segment, []byte(good+`{"op":"add","msg":{"f":"a","id":"ms`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := openTestStore(t, dir)
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, []string{"kept"}) {
+		t.Fatalf("loaded %v, want only the complete record", got)
+	}
+	data, _ := os.ReadFile(segment)
+	if string(data) != good {
+		t.Errorf("segment after loading = %q, want the torn record cut off", data)
+	}
+
+	post(t, s, "lobby", "after the crash")
+	s.Close()
+	s = openTestStore(t, dir)
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, []string{"kept", "after the crash"}) {
+		t.Errorf("after reopening = %v, the record written after the crash was lost", got)
+	}
+}
+
+func TestDiskRoomSkipsBadLines(t *testing.T) {
+	setFlag(t, historyRetain, 0)
+	dir := t.TempDir()
+	room := filepath.Join(dir, "history", "lobby")
+	os.MkdirAll(room, 0o755)
+	lines := `{"op":"add","msg":{"id":"msg_1","m":{"text":"a"}}}` + "\n" +
+		"not json\n" +
+		`{"op":"add","msg":{"id":"msg_2","m":{"text":"b"}}}` + "\n"
+	os.WriteFile(filepath.Join(room, "00000001.jsonl"), []byte(lines), 0o644)
+
+	s := openTestStore(t, dir)
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("loaded %v, want the lines around the bad one", got)
+	}
+}
+
+func TestDiskRoomTrim(t *testing.T) {
+	setFlag(t, historyRetain, 3)
+	useCacheSize(t, 0)
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	var sent []string
+	for i := 1; i <= 10; i++ {
+		sent = append(sent, post(t, s, "lobby", fmt.Sprint(i)))
+	}
+
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, []string{"8", "9", "10"}) {
+		t.Errorf("kept %v, want the last 3", got)
+	}
+	if _, found, _ := s.Get("lobby", sent[0]); found {
+		t.Error("a trimmed message is still found")
+	}
+	// positions of the kept messages must survive the trim.
+	for i, id := range sent[7:] {
+		msg, found, _ := s.Get("lobby", id)
+		if !found || msg.M.Text != fmt.Sprint(i+8) {
+			t.Errorf("Get(%s) = %v, %v", id, msg.M.Text, found)
+		}
+	}
+	if err := s.Update("lobby", MessageData{ID: sent[8], M: Message{Text: "nine"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, []string{"8", "nine", "10"}) {
+		t.Errorf("after an update = %v", got)
+	}
+
+	s.Close()
+	s = openTestStore(t, dir)
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, []string{"8", "nine", "10"}) {
+		t.Errorf("after reopening = %v", got)
+	}
+}
+
+func TestDiskRoomCompact(t *testing.T) {
+	setFlag(t, historyRetain, 0)
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	id := post(t, s, "lobby", "first")
+	post(t, s, "lobby", "second")
+	// every edit leaves a dead record behind.
+	for i := 0; i < 3*segmentRecords; i++ {
+		if err := s.Update("lobby", MessageData{ID: id, M: Message{Text: fmt.Sprint("edit ", i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := s.rooms["lobby"]
+	if r.total > 2*segmentRecords {
+		t.Errorf("%d records on disk for 2 messages, compaction did not run", r.total)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "history", "lobby", "*.jsonl"))
+	if len(files) != len(r.segments) {
+		t.Errorf("%d segment files, the room has %d", len(files), len(r.segments))
+	}
+
+	want := []string{fmt.Sprint("edit ", 3*segmentRecords-1), "second"}
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, want) {
+		t.Errorf("after compacting = %v, want %v", got, want)
+	}
+	s.Close()
+	s = openTestStore(t, dir)
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, want) {
+		t.Errorf("after reopening = %v, want %v", got, want)
+	}
+}
+
+func TestDiskRoomInterruptedCompaction(t *testing.T) {
+	setFlag(t, historyRetain, 0)
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	post(t, s, "lobby", "one")
+	post(t, s, "lobby", "two")
+	s.Close()
+
+	// the crash came after the compacted segment was written, before the
+	// manifest listed it.
+	room := filepath.Join(dir, "history", "lobby")
+	record := `{"op":"add","msg":{"id":"msg_1000","m":{"text":"compacted"}}}` + "\n"
+	os.WriteFile(filepath.Join(room, "00000002.jsonl"), []byte(record), 0o644)
+	s = openTestStore(t, dir)
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Errorf("loaded %v, want the segments of the manifest only", got)
+	}
+	if _, err := os.Stat(filepath.Join(room, "00000002.jsonl")); !os.IsNotExist(err) {
+		t.Error("the unlisted segment was not removed")
+	}
+	s.Close()
+
+	// the crash came after the manifest was replaced, before the old segment
+	// was removed.
+	os.WriteFile(filepath.Join(room, "00000003.jsonl"), []byte(record), 0o644)
+	os.WriteFile(filepath.Join(room, manifestName), []byte("[3]"), 0o644)
+	s = openTestStore(t, dir)
+	if got := texts(t, s, "lobby"); !reflect.DeepEqual(got, []string{"compacted"}) {
+		t.Errorf("loaded %v, want the compacted segment only", got)
+	}
+}
+
+func TestDiskStoreUnloadsRooms(t *testing.T) {
+	setFlag(t, historyRetain, 0)
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	for i := 0; i < loadedRooms+10; i++ {
+		post(t, s, fmt.Sprint("room", i), fmt.Sprint("in room ", i))
+	}
+	if len(s.rooms) > loadedRooms {
+		t.Errorf("%d rooms loaded, want at most %d", len(s.rooms), loadedRooms)
+	}
+	open := 0
+	for _, r := range s.rooms {
+		if r.file != nil {
+			open++
+		}
+	}
+	if open > loadedRooms {
+		t.Errorf("%d segment files open", open)
+	}
+
+	// only reading a room opens no file.
+	s.Recent("never-written", 10)
+	if r := s.rooms["never-written"]; r == nil || r.file != nil {
+		t.Error("reading a room opened its segment")
+	}
+
+	// an unloaded room is read from disk again.
+	if got := texts(t, s, "room0"); !reflect.DeepEqual(got, []string{"in room 0"}) {
+		t.Errorf("room0 after unloading = %v", got)
+	}
+}
+
+func TestSegmentNumber(t *testing.T) {
+	for name, want := range map[string]int{"00000001.jsonl": 1, "00000120.jsonl": 120} {
+		if got, ok := segmentNumber(name); !ok || got != want {
+			t.Errorf("segmentNumber(%q) = %d, %v", name, got, ok)
+		}
+	}
+	for _, name := range []string{"msgid", "1.json", "x.jsonl", ".00000001.jsonl.tmp"} {
+		if _, ok := segmentNumber(name); ok {
+			t.Errorf("segmentNumber(%q) accepted it", name)
+		}
+	}
+}
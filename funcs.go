@@ -12,38 +12,46 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// logLevels ranks the -log levels.
+var logLevels = map[string]int32{"DEBUG": 1, "INFO": 2, "ERROR": 3}
+
+// minLogLevel is the rank of -log, it changes when the config is reloaded.
+var minLogLevel atomic.Int32
+
+// setLogLevel; Sets the level logger writes from.
+func setLogLevel(level string) error {
+	rank, ok := logLevels[strings.ToUpper(level)]
+	if !ok {
+		return fmt.Errorf("%q is not DEBUG, INFO or ERROR", level)
+	}
+	minLogLevel.Store(rank)
+	return nil
+}
+
 // logger; A simple logger.
 // Accepts DEBUG, INFO, and ERROR level.
 func logger(level string, v ...interface{}) {
-	levels := map[string]int{"DEBUG": 1, "INFO": 2, "ERROR": 3}
-	currentLevel := levels[strings.ToUpper(*logLevel)]
-
-	if levels[strings.ToUpper(level)] >= currentLevel {
+	if logLevels[strings.ToUpper(level)] >= minLogLevel.Load() {
 		log.SetPrefix("[" + level + "] ")
 		log.Println(v...)
 	}
 }
 
-// addMessage; Append a message to cache.
-// If cacheSize == 0 nothing is added.
-func addMessage(msg MessageData) {
-	messageCache = append(messageCache, msg)
-
-	if len(messageCache) > *cacheSize {
-		messageCache = messageCache[1:]
-	}
-}
-
-// checkIfUserIn; Checks if user is in our userlist.
-// Returns true if "name" is in list.
+// checkIfUserIn; Checks if user is in any room.
+// Returns true if "name", or a nick that looks like it, is in a room's list.
 func checkIfUserIn(name string) bool {
-	for user := range userlist {
-		if userlist[user] == name {
-			// "user" is in.
-			return true
+	for _, hub := range rooms.all() {
+		for _, nick := range hub.userList() {
+			if sameNick(nick, name) {
+				// "user" is in.
+				return true
+			}
 		}
 	}
 	return false
@@ -65,6 +73,170 @@ func forceLogin(c *Client, message string) {
 	c.send <- forceLoginJson
 }
 
+// editableMessage; Looks up a message of the client's room that the client
+// may change. Sends the client an error event when it may not.
+// With moderated, moderators may change messages of others too.
+func editableMessage(c *Client, id string, moderated bool) (MessageData, bool) {
+	if c.nick() == "" {
+		forceLogin(c, "You need to be logged in to change a message.")
+		return MessageData{}, false
+	}
+
+	msg, found, err := history.Get(c.hub().name, id)
+	if err != nil {
+		logger("ERROR", "Failed to load message", id+":", err)
+		return MessageData{}, false
+	}
+	if !found || msg.Deleted {
+		sendError(c, "Message not found, it may be too old to change.")
+		return MessageData{}, false
+	}
+	if msg.From != c.nick() && !(moderated && isModerator(c) && rankOf(msg.From) < rankOf(c.nick())) {
+		sendError(c, "You can only change your own messages.")
+		return MessageData{}, false
+	}
+	return msg, true
+}
+
+// checkAttachment; Checks the attachment of a message of c is what it claims
+// to be, moves inline images into the file store and sets the thumbnail and
+// dimensions, clients can't. Sends c an error event if the message can't be
+// sent.
+func checkAttachment(c *Client, m *Message) bool {
+	if err := validateAttachment(m); err != nil {
+		logger("INFO", "Rejected attachment from", c.nick()+":", err)
+		sendError(c, err.Error())
+		return false
+	}
+	if err := attachImage(m); err != nil {
+		logger("ERROR", "Failed to attach image from", c.nick()+":", err)
+		sendError(c, "Could not store the image.")
+		return false
+	}
+	return true
+}
+
+// postMessage; Checks a message of c and sends it to its room.
+func postMessage(c *Client, incomingMessage MessageData) {
+	// muted nicks can't talk.
+	if left, reason := mutedFor(c.nick()); left > 0 {
+		sendError(c, fmt.Sprintf("You are muted for %s: %s.", left.Round(time.Second), reason))
+		return
+	}
+
+	if !checkAttachment(c, &incomingMessage.M) {
+		return
+	}
+
+	// repeated text, attachments or mass mentions get the nick muted.
+	if reason := checkSpam(c, incomingMessage.M); reason != "" {
+		muteNick(c.nick(), *muteTime, reason)
+		logger("INFO", "Muted", c.nick(), "in", c.hub().name, "for", *muteTime, "reason:", reason)
+		sendError(c, fmt.Sprintf("You are muted for %s: %s.", *muteTime, reason))
+		notifyModerators(fmt.Sprintf("%s was muted in %s for %s: %s.", c.nick(), c.hub().name, *muteTime, reason))
+		return
+	}
+
+	// replies always point at the first message of a thread.
+	replyTo := ""
+	if incomingMessage.ReplyTo != "" {
+		parent, found, err := history.Get(c.hub().name, incomingMessage.ReplyTo)
+		if err != nil {
+			logger("ERROR", "Failed to load message", incomingMessage.ReplyTo+":", err)
+			return
+		}
+		if !found {
+			sendError(c, "The message you replied to was not found.")
+			return
+		}
+		replyTo = parent.ID
+		if parent.ReplyTo != "" {
+			replyTo = parent.ReplyTo
+		}
+	}
+
+	c.hub().post.Lock()
+	defer c.hub().post.Unlock()
+	id, err := history.NextID()
+	if err != nil {
+		logger("ERROR", "Failed to allocate message id:", err)
+		return
+	}
+
+	msgData := MessageData{
+		From:    c.nick(),
+		ID:      id,
+		ReplyTo: replyTo,
+		M:       incomingMessage.M,
+		Action:  incomingMessage.Action,
+	}
+
+	outgoingMessage := Event{
+		Event: "new-msg",
+		Data:  msgData,
+	}
+
+	if newMessageJSON, err := json.Marshal(outgoingMessage); err == nil {
+		logger("DEBUG", "send-msg event triggered for:", c.nick())
+		touchBlobs(msgData.M)
+		// adds message to the room's history.
+		if err := history.Append(c.hub().name, msgData); err != nil {
+			logger("ERROR", "Failed to store message:", err)
+		}
+		// broadcast to the room, except clients without nick
+		c.hub().emit(newMessageJSON, nil)
+	} else {
+		logger("ERROR", "Failed to encode new-msg event:", err)
+	}
+}
+
+// sendError; sends client an error event.
+func sendError(c *Client, message string) {
+	errorEvent := Event{
+		Event: "error",
+		Data:  message,
+	}
+
+	errorJson, err := json.Marshal(errorEvent)
+	if err != nil {
+		logger("ERROR", "Failed to encode error event:", err)
+		return
+	}
+	c.send <- errorJson
+}
+
+// sendEvent; sends client an event with data.
+func sendEvent(c *Client, event string, data interface{}) {
+	eventJson, err := json.Marshal(Event{Event: event, Data: data})
+	if err != nil {
+		logger("ERROR", "Failed to encode", event, "event:", err)
+		return
+	}
+	c.send <- eventJson
+}
+
+// writeFileAtomic; Replaces the file at path with data, readers see either the
+// old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
 // middleware adds ETag headers to static file responses and handles conditional requests.
 func middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -94,9 +266,26 @@ func generateETag(path string) (string, error) {
 	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()), nil
 }
 
+// signalingAvailable; Encodes the signaling-available event, with the TURN
+// credentials of -command if it works.
+func signalingAvailable() ([]byte, error) {
+	iceServers, err := executeCommandFromFile()
+	if err != nil {
+		logger("ERROR", "Failed to execute command from file.", err)
+	}
+	availableEvent := Event{
+		Event: "signaling-available",
+		Data: EventData{
+			Enabled:    signalingEnabled.Load(),
+			IceServers: iceServers,
+		},
+	}
+	return json.Marshal(availableEvent)
+}
+
 func executeCommandFromFile() ([]Credential, error) {
 	// Read the command from a file
-	data, err := os.ReadFile(".command")
+	data, err := os.ReadFile(commandFile.Load().(string))
 	if err != nil {
 		return nil, fmt.Errorf("error reading file: %v", err)
 	}
@@ -4,7 +4,11 @@ go 1.21
 
 toolchain go1.24.0
 
-require github.com/fasthttp/websocket v1.5.12
+require (
+	github.com/fasthttp/websocket v1.5.12
+	golang.org/x/crypto v0.32.0
+	golang.org/x/text v0.21.0
+)
 
 require (
 	github.com/andybalholm/brotli v1.1.1 // indirect
@@ -0,0 +1,208 @@
+// File: history.go - Message history storage
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - HistoryStore is what the event handlers use to keep and replay messages.
+//  - memoryStore keeps the last -retain messages per room, lost on restart.
+//  - diskStore (diskstore.go) keeps history in JSON-lines segment files.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HistoryStore keeps the messages sent to each room.
+type HistoryStore interface {
+	// NextID allocates a new message id.
+	NextID() (string, error)
+	// Append adds msg to the history of room.
+	Append(room string, msg MessageData) error
+	// Recent returns up to n of the newest messages of room, oldest first.
+	Recent(room string, n int) ([]MessageData, error)
+	// Before returns up to limit messages of room older than the message id
+	// before, oldest first, and whether there are even older ones. An empty
+	// before starts from the newest message.
+	Before(room string, before string, limit int) ([]MessageData, bool, error)
+	// Get returns the message of room with the given id.
+	Get(room string, id string) (MessageData, bool, error)
+	// Replies returns the messages of room replying to the message id,
+	// oldest first.
+	Replies(room string, id string) ([]MessageData, error)
+	// Update replaces a stored message of room, matched by id.
+	Update(room string, msg MessageData) error
+	// Each calls fn for every stored message of every room.
+	Each(fn func(room string, msg MessageData)) error
+	// Close flushes pending writes and releases the store.
+	Close() error
+}
+
+var history HistoryStore
+
+// messages per room the memory store keeps when -retain is 0.
+const defaultMemoryRetain = 1000
+
+// serializes read-modify-write changes of stored messages.
+var historyMu sync.Mutex
+
+// openHistoryStore; Returns the history store selected by kind.
+func openHistoryStore(kind string, dir string) (HistoryStore, error) {
+	switch kind {
+	case "memory":
+		retain := *historyRetain
+		if retain == 0 {
+			retain = defaultMemoryRetain
+		}
+		return newMemoryStore(retain), nil
+	case "disk":
+		return openDiskStore(dir)
+	}
+	return nil, fmt.Errorf("unknown history store %q, expected memory or disk", kind)
+}
+
+// formatMessageID; Formats a message sequence number as an id.
+func formatMessageID(seq int64) string {
+	return fmt.Sprintf("msg_%d", seq)
+}
+
+// parseMessageID; Returns the sequence number of a message id, or -1.
+func parseMessageID(id string) int64 {
+	seq, err := strconv.ParseInt(strings.TrimPrefix(id, "msg_"), 10, 64)
+	if err != nil || !strings.HasPrefix(id, "msg_") {
+		return -1
+	}
+	return seq
+}
+
+// memoryStore keeps the last retain messages of every room, or -cache if that
+// is more.
+type memoryStore struct {
+	mu     sync.Mutex
+	msgid  int64
+	retain int
+	rooms  map[string][]MessageData
+}
+
+func newMemoryStore(retain int) *memoryStore {
+	return &memoryStore{retain: retain, rooms: make(map[string][]MessageData)}
+}
+
+func (s *memoryStore) NextID() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgid++
+	return formatMessageID(s.msgid), nil
+}
+
+// Append; pushes out old messages over the retain limit, new users still get
+// all of -cache.
+func (s *memoryStore) Append(room string, msg MessageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limit := max(s.retain, int(cacheSize.Load()))
+	msgs := append(s.rooms[room], msg)
+	if len(msgs) > limit {
+		msgs = msgs[len(msgs)-limit:]
+	}
+	s.rooms[room] = msgs
+	return nil
+}
+
+func (s *memoryStore) Recent(room string, n int) ([]MessageData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return tail(s.rooms[room], n), nil
+}
+
+func (s *memoryStore) Before(room string, before string, limit int) ([]MessageData, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs, more := page(s.rooms[room], before, limit)
+	return msgs, more, nil
+}
+
+func (s *memoryStore) Get(room string, id string) (MessageData, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range s.rooms[room] {
+		if msg.ID == id {
+			return msg, true, nil
+		}
+	}
+	return MessageData{}, false, nil
+}
+
+func (s *memoryStore) Replies(room string, id string) ([]MessageData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return replies(s.rooms[room], id), nil
+}
+
+func (s *memoryStore) Update(room string, msg MessageData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.rooms[room] {
+		if s.rooms[room][i].ID == msg.ID {
+			s.rooms[room][i] = msg
+			return nil
+		}
+	}
+	// pushed out already, nothing to update.
+	return nil
+}
+
+func (s *memoryStore) Each(fn func(room string, msg MessageData)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for room, msgs := range s.rooms {
+		for _, msg := range msgs {
+			fn(room, msg)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// tail; Returns a copy of the last n messages of msgs, never nil.
+func tail(msgs []MessageData, n int) []MessageData {
+	if n < 0 {
+		n = 0
+	}
+	if len(msgs) > n {
+		msgs = msgs[len(msgs)-n:]
+	}
+	return append([]MessageData{}, msgs...)
+}
+
+// page; Returns up to limit messages older than the id before, and whether
+// msgs holds even older ones.
+func page(msgs []MessageData, before string, limit int) ([]MessageData, bool) {
+	end := len(msgs)
+	if before != "" {
+		seq := parseMessageID(before)
+		end = sort.Search(len(msgs), func(i int) bool {
+			return parseMessageID(msgs[i].ID) >= seq
+		})
+	}
+	start := max(end-limit, 0)
+	return append([]MessageData{}, msgs[start:end]...), start > 0
+}
+
+// replies; Returns the messages of msgs replying to the message id.
+func replies(msgs []MessageData, id string) []MessageData {
+	found := []MessageData{}
+	for _, msg := range msgs {
+		if msg.ReplyTo == id {
+			found = append(found, msg)
+		}
+	}
+	return found
+}
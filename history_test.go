@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// the expected errors would only clutter the output.
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// setFlag; Sets a flag for the length of the test.
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	old := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = old })
+}
+
+// useCacheSize; Sets -cache for the length of the test.
+func useCacheSize(t *testing.T, size int) {
+	old := cacheSize.Load()
+	cacheSize.Store(int64(size))
+	t.Cleanup(func() { cacheSize.Store(old) })
+}
+
+// numbered; Returns messages with ids msg_from to msg_to.
+func numbered(from int64, to int64) []MessageData {
+	var msgs []MessageData
+	for seq := from; seq <= to; seq++ {
+		msgs = append(msgs, MessageData{ID: formatMessageID(seq), M: Message{Text: formatMessageID(seq)}})
+	}
+	return msgs
+}
+
+func ids(msgs []MessageData) []string {
+	list := []string{}
+	for _, msg := range msgs {
+		list = append(list, msg.ID)
+	}
+	return list
+}
+
+func TestParseMessageID(t *testing.T) {
+	tests := map[string]int64{
+		"msg_1":   1,
+		"msg_42":  42,
+		"msg_":    -1,
+		"42":      -1,
+		"msg_x":   -1,
+		"":        -1,
+		"xmsg_12": -1,
+	}
+	for id, want := range tests {
+		if got := parseMessageID(id); got != want {
+			t.Errorf("parseMessageID(%q) = %d, want %d", id, got, want)
+		}
+	}
+}
+
+func TestPage(t *testing.T) {
+	msgs := numbered(1, 10)
+	tests := []struct {
+		name   string
+		before string
+		limit  int
+		want   []string
+		more   bool
+	}{
+		{"newest", "", 3, ids(numbered(8, 10)), true},
+		{"everything", "", 20, ids(msgs), false},
+		{"before", "msg_5", 2, ids(numbered(3, 4)), true},
+		{"reaches the start", "msg_4", 5, ids(numbered(1, 3)), false},
+		{"before the first", "msg_1", 5, []string{}, false},
+		{"unknown newer id", "msg_99", 2, ids(numbered(9, 10)), true},
+		{"gap in ids", "msg_0", 2, []string{}, false},
+	}
+	for _, test := range tests {
+		got, more := page(msgs, test.before, test.limit)
+		if !reflect.DeepEqual(ids(got), test.want) || more != test.more {
+			t.Errorf("%s: page(%q, %d) = %v, %v, want %v, %v", test.name, test.before, test.limit, ids(got), more, test.want, test.more)
+		}
+	}
+}
+
+func TestPageCopies(t *testing.T) {
+	msgs := numbered(1, 3)
+	got, _ := page(msgs, "", 3)
+	got[0].M.Text = "changed"
+	if msgs[0].M.Text == "changed" {
+		t.Error("page returned the stored messages, not a copy")
+	}
+}
+
+func TestTail(t *testing.T) {
+	msgs := numbered(1, 5)
+	if got := ids(tail(msgs, 2)); !reflect.DeepEqual(got, []string{"msg_4", "msg_5"}) {
+		t.Errorf("tail(2) = %v", got)
+	}
+	if got := tail(msgs, 0); got == nil || len(got) != 0 {
+		t.Errorf("tail(0) = %#v, want an empty slice", got)
+	}
+	if got := tail(nil, -1); got == nil || len(got) != 0 {
+		t.Errorf("tail(-1) = %#v, want an empty slice", got)
+	}
+}
+
+func TestMemoryStoreRetain(t *testing.T) {
+	useCacheSize(t, 0)
+	s := newMemoryStore(3)
+	for _, msg := range numbered(1, 5) {
+		s.Append("lobby", msg)
+	}
+	recent, _ := s.Recent("lobby", 10)
+	if got := ids(recent); !reflect.DeepEqual(got, []string{"msg_3", "msg_4", "msg_5"}) {
+		t.Errorf("kept %v, want the last 3", got)
+	}
+	if _, found, _ := s.Get("lobby", "msg_5"); !found {
+		t.Error("the newest message is not found")
+	}
+
+	// new users get all of -cache even if it is more than retain.
+	useCacheSize(t, 4)
+	s.Append("lobby", numbered(6, 6)[0])
+	recent, _ = s.Recent("lobby", 10)
+	if len(recent) != 4 {
+		t.Errorf("kept %d messages with -cache 4, want 4", len(recent))
+	}
+}
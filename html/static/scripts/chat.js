@@ -8,6 +8,7 @@ var Chat = {
 	msgs_list: document.getElementById("msgs"),
 	typing_list: document.getElementById("typing"),
 	users: document.getElementById("users"),
+	topic_bar: document.getElementById("topic"),
 	textarea: document.getElementById("form_input"),
 	send_btn: document.getElementById("send"),
 
@@ -15,6 +16,7 @@ var Chat = {
 	is_online: false,
 	is_typing: false,
 	last_sent_nick: null,
+	oldest_id: null,
 
 	original_title: document.title,
 	new_title: "New messages...",
@@ -145,14 +147,30 @@ var Chat = {
 		}
 	},
 
+	reply_to: null,
+
+	// own role: user, moderator or owner
+	role: "user",
+
 	send_msg: function(text){
-		Chat.send( { event: "send-msg", data: { m: text }} );
+		var data = { m: text };
+		if(Chat.reply_to !== null){
+			data.replyTo = Chat.reply_to;
+			Chat.thread.cancel();
+		}
+		Chat.send( { event: "send-msg", data: data } );
 	},
 
 	send_event: function(){
 		var value = Chat.textarea.value.trim();
 		if(value == "") return;
 
+		// account commands never go out as messages, they carry passwords.
+		if(Chat.account.command(value)){
+			Chat.textarea.value = '';
+			return;
+		}
+
 		console.log("Send message.");
 
 		Chat.send_msg({text: value});
@@ -199,69 +217,382 @@ var Chat = {
 			}
 		},
 
-		event: function(r){
-			if(r.status){
-				Chat.typing.create(r.nick);
-			} else {
-				Chat.typing.remove(r.nick);
+		// Everyone typing in the room, sent by the server when it changes
+		list: function(nicks){
+			nicks = (nicks || []).filter(nick => nick != sessionStorage.nick);
+			for(var nick in Chat.typing.objects){
+				if(nicks.indexOf(nick) < 0){
+					Chat.typing.remove(nick);
+				}
 			}
+			nicks.forEach(nick => {
+				if(!Chat.typing.objects.hasOwnProperty(nick)){
+					Chat.typing.create(nick);
+				}
+			});
 		},
 
+		// when typing was last sent, the server forgets it after a few seconds
+		sent_at: 0,
+
 		update: function(){
 			if(Chat.is_typing && Chat.textarea.value === ""){
 				Chat.send({ event: "typing", data: Chat.is_typing = false});
 			}
 
-			if(!Chat.is_typing && Chat.textarea.value !== ""){
+			if(Chat.textarea.value !== "" && (!Chat.is_typing || Date.now() - Chat.typing.sent_at > 3000)){
+				Chat.typing.sent_at = Date.now();
 				Chat.send({event: 'typing', data: Chat.is_typing = true});
 			}
 		}
 	},
 
-	new_msg: function(r){
+	// live is false for messages replayed from history
+	new_msg: function(r, live){
+		// already shown, replayed after a resume
+		if(r.id && document.getElementById(r.id)){
+			return;
+		}
 		console.log("New message.");
-		const fromSelf = sessionStorage.nick == r.f;
 
 		// Notify user
 		Chat.notif.create(r.f, r.m);
 
+		var grouped = !r.to && Chat.last_sent_nick === r.f;
+		if(!grouped){
+			Chat.last_sent_nick = r.to ? null : r.f;
+		}
+
+		// Prepend because flex-direction: column-reverse
+		Chat.msgs_list.prepend(Chat.render_msg(r, grouped));
+		if(Chat.oldest_id === null){
+			Chat.oldest_id = r.id;
+		}
+
+		if(!r.to){
+			Chat.receipts.newest_id = r.id;
+			if(live && sessionStorage.nick != r.f){
+				Chat.send({ event: "ack", data: { id: r.id }});
+			}
+			Chat.receipts.read();
+		}
+
+		// Scroll to new message
+		Chat.scroll();
+	},
+
+	render_msg: function(r, grouped){
+		const fromSelf = sessionStorage.nick == r.f;
+
 		var li = document.createElement('div');
 		li.id = r.id;
 
 		var prefix = document.createElement('span');
 		prefix.className = 'prefix';
-		prefix.innerText = r.f;
+		prefix.innerText = r.to ? r.f + ' \u2192 ' + r.to : r.f;
 		li.appendChild(prefix);
 
-		if(Chat.last_sent_nick === r.f){
+		if(grouped){
 			prefix.style.display = "none";
 			li.prefix = prefix;
-		} else {
-			Chat.last_sent_nick = r.f;
 		}
 
 		var msg = document.createElement('div');
 		msg.className = 'message';
 
+		if(r.replyTo){
+			var reply = document.createElement('a');
+			reply.className = 'reply-to';
+			reply.href = '#';
+			var parent = document.getElementById(r.replyTo);
+			var quote = parent ? parent.querySelector('.body').innerText : '';
+			reply.innerText = '\u21aa ' + (quote ? quote.substring(0, 40) : 'earlier message');
+			reply.onclick = function(e){
+				e.preventDefault();
+				Chat.thread.fetch(r.replyTo);
+			};
+			msg.appendChild(reply);
+		}
+
 		var body = document.createElement('span');
-		body.className = 'body' + (fromSelf ? ' out' : ' in');
-		Chat.append_msg(body, r.m);
+		body.className = 'body' + (fromSelf ? ' out' : ' in') + (r.to ? ' dm' : '');
+		Chat.fill_body(body, r);
 
 		msg.appendChild(body);
 
+		var reactions = document.createElement('div');
+		reactions.className = 'reactions';
+		Chat.reactions.fill(reactions, r);
+		msg.appendChild(reactions);
+
+		// Double click to edit or delete own messages
+		if(fromSelf && !r.to){
+			msg.ondblclick = function(){
+				Chat.edit_msg(r.id, body);
+			};
+		}
+
 		li.appendChild(msg);
 
+		if(fromSelf && !r.to){
+			var status = document.createElement('small');
+			status.className = 'receipt';
+			li.appendChild(status);
+		}
+
 		var c = document.createElement('li');
 		c.appendChild(li);
 		if (fromSelf){
 			c.classList.add('message-from-self');
 		}
+		return c;
+	},
 
-		// Prepend because flex-direction: column-reverse
-		Chat.msgs_list.prepend(c);
+	fill_body: function(body, r){
+		body.innerText = '';
+		body.classList.toggle('deleted', !!r.deleted);
+		if(r.deleted){
+			body.innerText = 'Message deleted.';
+			return;
+		}
 
-		// Scroll to new message
-		Chat.scroll();
+		Chat.append_msg(body, r.m);
+
+		// /me
+		body.classList.toggle('action', !!r.action);
+		if(r.action){
+			var actor = document.createElement('span');
+			actor.innerText = '* ' + r.f + ' ';
+			body.prepend(actor);
+		}
+		if(r.edited){
+			var edited = document.createElement('small');
+			edited.className = 'edited';
+			edited.innerText = ' (edited)';
+			body.appendChild(edited);
+		}
+	},
+
+	edit_msg: function(id, body){
+		if(body.classList.contains('deleted')){
+			return;
+		}
+
+		var text = prompt("Edit message, leave empty to delete it:", body.dataset.text || "");
+		if(text === null){
+			return;
+		}
+
+		if(text.trim() === ""){
+			Chat.send({ event: "delete-msg", data: { id: id }});
+		} else {
+			Chat.send({ event: "edit-msg", data: { id: id, m: { text: text }}});
+		}
+	},
+
+	// Message changed after it was sent
+	update_msg: function(r){
+		var li = document.getElementById(r.id);
+		if(!li){
+			return;
+		}
+
+		var body = li.querySelector('.body');
+		Chat.fill_body(body, r);
+		Chat.reactions.fill(li.querySelector('.reactions'), r);
+	},
+
+	reactions: {
+		fill: function(el, r){
+			el.innerText = '';
+			if(r.deleted || r.to){
+				return;
+			}
+
+			var reactions = r.reactions || {};
+			for(var emoji in reactions){
+				var btn = document.createElement('button');
+				btn.className = 'reaction';
+				if(reactions[emoji].indexOf(sessionStorage.nick) >= 0){
+					btn.classList.add('mine');
+				}
+				btn.title = reactions[emoji].join(', ');
+
+				// emic slugs are shown as images
+				if(emoji.match(/^[a-z0-9-]+$/)){
+					btn.innerHTML = '<img src="static/emic/' + emoji + '.png" width="16px" height="16px">';
+				} else {
+					btn.innerText = emoji;
+				}
+				btn.appendChild(document.createTextNode(' ' + reactions[emoji].length));
+				btn.onclick = (function(emoji){
+					return function(){
+						Chat.reactions.send(r.id, emoji);
+					};
+				})(emoji);
+				el.appendChild(btn);
+			}
+
+			var add = document.createElement('button');
+			add.className = 'reaction add';
+			add.innerText = '+';
+			add.title = 'React';
+			add.onclick = function(){
+				var emoji = prompt("React with an emoji:");
+				if(emoji && emoji.trim() !== ""){
+					Chat.reactions.send(r.id, emoji.trim().replace(/^\*(.*)\*$/, '$1'));
+				}
+			};
+			el.appendChild(add);
+
+			var reply = document.createElement('button');
+			reply.className = 'reaction add';
+			reply.innerText = '\u21a9';
+			reply.title = 'Reply';
+			reply.onclick = function(){
+				Chat.thread.reply(r.id);
+			};
+			el.appendChild(reply);
+		},
+
+		send: function(id, emoji){
+			Chat.send({ event: "react", data: { id: id, emoji: emoji }});
+		},
+
+		update: function(r){
+			var li = document.getElementById(r.id);
+			if(!li){
+				return;
+			}
+
+			Chat.reactions.fill(li.querySelector('.reactions'), r);
+		}
+	},
+
+	receipts: {
+		// nick -> last read message id
+		reads: {},
+		delivered: {},
+		newest_id: null,
+		sent_read: null,
+
+		seq: function(id){
+			return parseInt(String(id).replace('msg_', ''), 10) || 0;
+		},
+
+		// Tell the server we have seen the newest message
+		read: function(){
+			var id = Chat.receipts.newest_id;
+			if(!Chat.is_focused || id === null || id === Chat.receipts.sent_read){
+				return;
+			}
+
+			Chat.receipts.sent_read = id;
+			Chat.send({ event: "read", data: { id: id }});
+		},
+
+		start: function(reads){
+			Chat.receipts.reads = reads || {};
+			Chat.receipts.delivered = {};
+			Chat.receipts.render();
+		},
+
+		event: function(r){
+			if(r.kind === 'read'){
+				Chat.receipts.reads[r.nick] = r.id;
+			} else {
+				Chat.receipts.delivered[r.id] = Chat.receipts.delivered[r.id] || {};
+				Chat.receipts.delivered[r.id][r.nick] = true;
+			}
+			Chat.receipts.render();
+		},
+
+		// Show who has read each of our own messages
+		render: function(){
+			document.querySelectorAll('.msgs .receipt').forEach(function(el){
+				var id = el.parentNode.id;
+				var seq = Chat.receipts.seq(id);
+				var readers = [];
+				for(var nick in Chat.receipts.reads){
+					if(nick != sessionStorage.nick && Chat.receipts.seq(Chat.receipts.reads[nick]) >= seq){
+						readers.push(nick);
+					}
+				}
+
+				if(readers.length){
+					el.innerText = '\u2713\u2713';
+					el.title = 'Read by ' + readers.join(', ');
+				} else if(Chat.receipts.delivered[id]){
+					el.innerText = '\u2713';
+					el.title = 'Delivered to ' + Object.keys(Chat.receipts.delivered[id]).join(', ');
+				} else {
+					el.innerText = '';
+					el.title = '';
+				}
+			});
+		}
+	},
+
+	thread: {
+		reply: function(id){
+			Chat.reply_to = id;
+			Chat.textarea.placeholder = "Reply ...";
+			Chat.textarea.focus();
+		},
+
+		cancel: function(){
+			Chat.reply_to = null;
+			Chat.textarea.placeholder = "Type something ...";
+		},
+
+		fetch: function(id){
+			Chat.send({ event: "fetch-thread", data: { id: id }});
+		},
+
+		// Highlight the thread's messages that are loaded
+		show: function(r){
+			document.querySelectorAll('.msgs .in-thread').forEach(function(el){
+				el.classList.remove('in-thread');
+			});
+
+			[r.parent].concat(r.replies).forEach(function(m){
+				var li = document.getElementById(m.id);
+				if(li){
+					li.classList.add('in-thread');
+				}
+			});
+
+			var parent = document.getElementById(r.parent.id);
+			if(parent){
+				parent.scrollIntoView({ behavior: 'smooth', block: 'center' });
+			}
+		}
+	},
+
+	history: {
+		loading: false,
+		has_more: true,
+
+		// Ask for messages older than the oldest one shown
+		fetch: function(){
+			if(Chat.history.loading || !Chat.history.has_more || Chat.oldest_id === null){
+				return;
+			}
+
+			Chat.history.loading = true;
+			Chat.send({ event: "fetch-history", data: { before: Chat.oldest_id, limit: 50 }});
+		},
+
+		page: function(r){
+			Chat.history.loading = false;
+			Chat.history.has_more = r.hasMore;
+
+			// Oldest first, each one goes above the previous
+			for(var i = r.msgs.length - 1; i >= 0; i--){
+				Chat.msgs_list.appendChild(Chat.render_msg(r.msgs[i], false));
+				Chat.oldest_id = r.msgs[i].id;
+			}
+		}
 	},
 
 	append_msg: function(el, msg){
@@ -270,6 +601,7 @@ var Chat = {
 		// If is object
 		if(typeof msg.text !== 'undefined'){
 			// Escape HTML
+			el.dataset.text = msg.text;
 			el.innerText = msg.text;
 			var text = el.innerHTML;
 
@@ -308,7 +640,26 @@ var Chat = {
 			if(msg.type.match(/image.*/)){
 				var img = document.createElement('img');
 				img.style = 'max-width:100%;';
-				img.src = msg.url;
+				if(msg.width && msg.height){
+					img.width = msg.width;
+					img.height = msg.height;
+					img.style = 'max-width:100%;height:auto;';
+				}
+
+				// Show the thumbnail, full size only when clicked
+				if(msg.thumbUrl){
+					img.src = msg.thumbUrl;
+					img.className = 'thumb';
+					img.title = 'Click to load full size';
+					img.onclick = function(){
+						img.onclick = null;
+						img.className = '';
+						img.title = '';
+						img.src = msg.url;
+					};
+				} else {
+					img.src = msg.url;
+				}
 				el.appendChild(img);
 				return;
 			}
@@ -343,52 +694,196 @@ var Chat = {
 
 		var nick = prompt("Your nick:", sessionStorage.nick || localStorage.nick || "").trim();
 		if(typeof nick !== "undefined" && nick){
+			if(nick != sessionStorage.nick){
+				delete sessionStorage.password;
+			}
 			sessionStorage.nick = localStorage.nick = nick;
-			let data = { event: "login", data: { nick: nick } }
+			let data = { event: "login", data: { nick: nick, password: sessionStorage.password } }
 			Chat.send(data);
 		}
 	},
 
+	// nick is registered, ask for its password.
+	login_password: function(reason){
+		var password = prompt(reason + "\nPassword for " + sessionStorage.nick + " (cancel to pick another nick):");
+		if(password === null || password === ""){
+			delete sessionStorage.password;
+			Chat.force_login();
+			return;
+		}
+		sessionStorage.password = password;
+		let data = { event: "login", data: { nick: sessionStorage.nick, password: password } }
+		Chat.send(data);
+	},
+
 	reload: function(){
 		if(typeof sessionStorage.nick !== "undefined" && sessionStorage.nick){
-			let data = { event: "login", data: { nick: sessionStorage.nick } }
+			let data = { event: "login", data: { nick: sessionStorage.nick, password: sessionStorage.password } }
 			Chat.send(data);
 		}
 	},
 
+	account: {
+		// Handles /register, /password and /unregister, returns true if text was one.
+		command: function(text){
+			var args = text.split(/\s+/);
+			switch(args[0]){
+				case "/register":
+					var password = prompt("Password for " + sessionStorage.nick + ":");
+					if(password && password === prompt("Repeat the password:")){
+						Chat.account.pending = password;
+						Chat.send({ event: "register-nick", data: { password: password } });
+					} else if(password){
+						alert("Passwords don't match.");
+					}
+					return true;
+				case "/password":
+					var old = prompt("Current password:");
+					var password = old && prompt("New password:");
+					if(password && password === prompt("Repeat the new password:")){
+						Chat.account.pending = password;
+						Chat.send({ event: "change-password", data: { password: old, newPassword: password } });
+					} else if(password){
+						alert("Passwords don't match.");
+					}
+					return true;
+				case "/unregister":
+					// "/unregister" drops the own nick, "/unregister nick token" any with the admin token.
+					if(args.length >= 3){
+						Chat.send({ event: "unregister-nick", data: { nick: args.slice(1, -1).join(" "), token: args[args.length - 1] } });
+						return true;
+					}
+					var password = prompt("Password of " + sessionStorage.nick + ":");
+					if(password){
+						Chat.send({ event: "unregister-nick", data: { password: password } });
+					}
+					return true;
+			}
+			return false;
+		},
+
+		pending: null,
+
+		event: function(kind, r){
+			switch(kind){
+				case "nick-registered":
+				case "password-changed":
+					sessionStorage.password = Chat.account.pending;
+					alert(kind == "nick-registered" ? r.nick + " is registered now." : "Password changed.");
+					break;
+				case "nick-unregistered":
+					if(r.nick == sessionStorage.nick){
+						delete sessionStorage.password;
+					}
+					alert(r.nick + " is not registered anymore.");
+					break;
+			}
+			Chat.account.pending = null;
+		}
+	},
+
 	user: {
 		objects: {},
 
 		// Load all users
 		start: function(r){
 			Chat.users.innerText = '';
+			if(r.nick){
+				sessionStorage.nick = localStorage.nick = r.nick;
+			}
+			if(r.token){
+				sessionStorage.resume_token = r.token;
+			}
+			Chat.upload_token = r.upload;
+			Chat.role = r.role || "user";
+			Chat.topic.show(r.topic);
+			Chat.typing_list.innerText = '';
+			Chat.typing.objects = {};
+			Chat.typing.list(r.typing);
+			if(r.motd && r.motd !== Chat.topic.motd){
+				Chat.topic.motd = r.motd;
+				Chat.notice({ text: r.motd });
+			}
 
+			Chat.user.objects = {};
 			for(var user in r.users){
-				var nick = document.createElement('li');
-				nick.innerText = r.users[user];
-				Chat.users.appendChild(nick);
-				Chat.user.objects[r.users[user]] = nick;
+				Chat.user.add(r.users[user]);
+			}
+		},
+
+		// Add a roster entry to the user list
+		add: function(entry){
+			var nick = document.createElement('li');
+			nick.innerText = entry.nick;
+			Chat.users.appendChild(nick);
+			Chat.user.objects[entry.nick] = nick;
+			Chat.user.presence(entry);
+		},
+
+		// Show the state and status of a nick: online, away, busy or idle
+		presence: function(entry){
+			var nick = Chat.user.objects[entry.nick];
+			if(!nick){
+				return;
 			}
+			nick.className = 'presence-' + (entry.state || 'online');
+			nick.title = entry.state + (entry.status ? ': ' + entry.status : '');
 		},
 
 		previous_messages: function(data){
 			console.log(`msgs:`, JSON.stringify(data))
 
 			data.msgs.forEach(element => {
-				Chat.new_msg(element)
+				Chat.new_msg(element, false)
 			});
+			Chat.receipts.render();
 		},
 
 		// User joined room
 		enter: function(r){
 			console.log("User " + r.nick + " joined.");
 
-			var nick = document.createElement('li');
-			nick.innerText = r.nick;
-			Chat.users.appendChild(nick);
-			Chat.user.objects[r.nick] = nick;
+			Chat.user.add({ nick: r.nick, state: 'online' });
+		},
+
+		// User changed nick, relabel it. Old messages keep the old one.
+		rename: function(r){
+			console.log("User " + r.old + " is now " + r.nick + ".");
+
+			Chat.typing.remove(r.old);
+			if(Chat.receipts.reads.hasOwnProperty(r.old)){
+				Chat.receipts.reads[r.nick] = Chat.receipts.reads[r.old];
+				delete Chat.receipts.reads[r.old];
+			}
+			if(Chat.user.objects.hasOwnProperty(r.old)){
+				var element = Chat.user.objects[r.old];
+				element.innerText = r.nick;
+				delete Chat.user.objects[r.old];
+				Chat.user.objects[r.nick] = element;
+			}
+			if(r.old == sessionStorage.nick){
+				sessionStorage.nick = localStorage.nick = r.nick;
+				Chat.role = r.role || "user";
+				if(Chat.user.pending_password){
+					sessionStorage.password = Chat.user.pending_password;
+				} else {
+					delete sessionStorage.password;
+				}
+				Chat.user.pending_password = null;
+			}
 		},
 
+		// the new nick is registered, ask for its password.
+		nick_password: function(r){
+			var password = prompt(r.reason + "\nPassword for " + r.nick + ":");
+			if(password){
+				Chat.user.pending_password = password;
+				Chat.send({ event: "change-nick", data: { nick: r.nick, password: password } });
+			}
+		},
+
+		pending_password: null,
+
 		// User left room
 		leave: function(r){
 			console.log("User " + r.nick + " left.");
@@ -411,22 +906,81 @@ var Chat = {
 		Chat.is_online = true;
 
 		document.getElementById('offline').style.display = "none";
-		Chat.msgs_list.innerText = '';
 		Chat.typing_list.innerText = '';
 		Chat.users.innerText = '';
-		Chat.last_sent_nick = '';
 
+		// pick up where the dropped connection left off
+		if(sessionStorage.resume_token){
+			Chat.send({ event: "resume", data: { token: sessionStorage.resume_token, lastId: Chat.receipts.newest_id }});
+			return;
+		}
+
+		Chat.reset();
 		// force user to login
 		Chat.force_login();
 	},
 
+	topic: {
+		// last message of the day shown, it is only shown once.
+		motd: null,
+
+		// Show the room topic above the messages, hide the bar without one.
+		show: function(topic){
+			Chat.topic_bar.innerText = '';
+			if(!topic || !topic.text){
+				Chat.topic_bar.classList.add('display-none');
+				return;
+			}
+			Chat.append_msg(Chat.topic_bar, { text: topic.text });
+			Chat.topic_bar.title = 'Set by ' + topic.by + ' on ' + new Date(topic.set).toLocaleString();
+			Chat.topic_bar.classList.remove('display-none');
+		},
+
+		// Topic changed while in the room
+		changed: function(topic){
+			Chat.topic.show(topic);
+			Chat.notice({ text: topic.text ? topic.by + ' set the topic: ' + topic.text : topic.by + ' cleared the topic.' });
+		}
+	},
+
+	// system message, e.g. a moderation
+	notice: function(r){
+		var li = document.createElement('div');
+		li.className = 'notice';
+		li.innerText = r.text;
+		Chat.msgs_list.prepend(li);
+		Chat.last_sent_nick = null;
+		Chat.scroll();
+	},
+
+	// session could not be resumed, start over
+	resume_failed: function(reason){
+		console.warn("Resume failed:", reason);
+		delete sessionStorage.resume_token;
+		Chat.reset();
+		Chat.force_login();
+	},
+
+	reset: function(){
+		Chat.msgs_list.innerText = '';
+		Chat.last_sent_nick = '';
+		Chat.oldest_id = null;
+		Chat.receipts.newest_id = null;
+		Chat.receipts.sent_read = null;
+		Chat.history.loading = false;
+		Chat.history.has_more = true;
+	},
+
 	disconnect: function(){
 		// Set green favicon
 		Chat.notif.favicon('red');
 		Chat.is_online = false;
 
 		document.getElementById('offline').style.display = "block";
-		Chat.msgs_list.innerText = '';
+		// messages stay if the session can be resumed
+		if(!sessionStorage.resume_token){
+			Chat.msgs_list.innerText = '';
+		}
 		Chat.typing_list.innerText = '';
 		Chat.users.innerText = '';
 	},
@@ -461,6 +1015,8 @@ var Chat = {
 
 			// Set back page title
 			document.title = Chat.original_title;
+
+			Chat.receipts.read();
 		});
 
 		// On blur
@@ -468,6 +1024,13 @@ var Chat = {
 			Chat.is_focused = false;
 		});
 
+		// Load older messages when scrolled to the top
+		Chat.chat_box.addEventListener('scroll', function(){
+			if(Chat.chat_box.scrollTop === 0){
+				Chat.history.fetch();
+			}
+		});
+
 		// On click send message
 		Chat.send_btn.onclick = Chat.send_event;
 
@@ -475,6 +1038,12 @@ var Chat = {
 		Chat.textarea.onkeydown = function(e){
 			var key = e.keyCode || window.event.keyCode;
 
+			// Escape cancels a reply
+			if(key === 27){
+				Chat.thread.cancel();
+				return true;
+			}
+
 			// If the user has pressed enter
 			if(key === 13){
 				Chat.send_event();
@@ -504,27 +1073,37 @@ var Chat = {
 
 			var files = e.dataTransfer.files; // Array of all files
 			for(var i = 0;i < files.length;i++){
-				var file = files[i];
+				Chat.upload(files[i]);
+			}
+		});
+	},
 
-				// Max 10 MB
-				if(file.size > 10485760){
-					alert("Max size of file is 10MB");
-					return;
-				}
+	// Store the file on the server, then send a message pointing at it
+	upload: async function(file){
+		var form = new FormData();
+		form.append('file', file, file.name);
 
-				var reader = new FileReader();
-				reader.onload = (function(file){
-					return function(e){
-						Chat.send_msg({
-							type: file.type,
-							name: file.name,
-							url: e.target.result
-						});
-					};
-				})(file);
-				reader.readAsDataURL(file);
+		try {
+			var res = await fetch('upload', {
+				method: 'POST',
+				headers: { 'X-Upload-Token': Chat.upload_token || '' },
+				body: form
+			});
+			if(!res.ok){
+				alert(await res.text());
+				return;
 			}
-		});
+
+			var stored = await res.json();
+			Chat.send_msg({
+				type: stored.type,
+				name: stored.name,
+				url: stored.url
+			});
+		} catch (e) {
+			console.error("Upload failed:", e);
+			alert("Upload failed.");
+		}
 	},
 
 	socketlisteners: function() {
@@ -536,8 +1115,13 @@ var Chat = {
 			Chat.keepalive();
 		});
 
-		Chat.socket.addEventListener("close", function() {
+		Chat.socket.addEventListener("close", function(e) {
 			console.debug('Received close on websocket');
+			// kicked or banned, the session is gone
+			if(e.code >= 4000){
+				delete sessionStorage.resume_token;
+				alert(e.reason);
+			}
 			Chat.disconnect();
 		});
 
@@ -562,23 +1146,74 @@ var Chat = {
 				case "force-login":
 					Chat.force_login(message.data);
 					break;
-				case "typing":
-					Chat.typing.event(message.data);
+				case "notice":
+					Chat.notice(message.data);
+					break;
+				case "resume-failed":
+					Chat.resume_failed(message.data);
+					break;
+				case "login-password":
+					Chat.login_password(message.data);
+					break;
+				case "nick-registered":
+				case "password-changed":
+				case "nick-unregistered":
+					Chat.account.event(message.event, message.data);
+					break;
+				case "error":
+					console.warn("Server error:", message.data);
+					alert(message.data);
+					break;
+				case "rate-limited":
+					console.warn("Slow down,", message.data.event, "was dropped. Retry in", message.data.retryAfter, "ms");
+					break;
+				case "typing-list":
+					Chat.typing.list(message.data.nicks);
 					break;
 				case "new-msg":
-					Chat.new_msg(message.data);
+				case "new-dm":
+					Chat.new_msg(message.data, true);
+					break;
+				case "receipt":
+					Chat.receipts.event(message.data);
 					break;
 				case "previous-msg":
 					Chat.user.previous_messages(message);
 					break;
+				case "msg-edited":
+				case "msg-deleted":
+					Chat.update_msg(message.data);
+					break;
+				case "reaction-update":
+					Chat.reactions.update(message.data);
+					break;
+				case "thread":
+					Chat.thread.show(message.data);
+					break;
+				case "history-page":
+					Chat.history.page(message.data);
+					break;
 				case "start":
 					Chat.user.start(message.data);
+					Chat.receipts.start(message.data.reads);
 					const event = new CustomEvent("chat-active");
 					window.dispatchEvent(event);
 					break;
 				case "ue": // User entered
 					Chat.user.enter(message.data);
 					break;
+				case "presence":
+					Chat.user.presence(message.data);
+					break;
+				case "topic-changed":
+					Chat.topic.changed(message.data);
+					break;
+				case "nick-changed":
+					Chat.user.rename(message.data);
+					break;
+				case "nick-password":
+					Chat.user.nick_password(message.data);
+					break;
 				case "ul": // User left
 					Chat.user.leave(message.data);
 					const userLeft = new CustomEvent("ul");
@@ -153,8 +153,14 @@ var WebRTC = {
             }
             if (event.data.enabled === true) {
                 this.checkMediaDevices();
-                navigator.mediaDevices.addEventListener("devicechange", () => this.checkMediaDevices());
-                navigator.mediaDevices.addEventListener("devicechange", () => this.populateOptions());
+                // the server may announce it again after a reload.
+                if (!this.watchingDevices) {
+                    this.watchingDevices = true;
+                    navigator.mediaDevices.addEventListener("devicechange", () => this.checkMediaDevices());
+                    navigator.mediaDevices.addEventListener("devicechange", () => this.populateOptions());
+                }
+            } else {
+                document.getElementById('audioControls').classList.add('display-none');
             }
             if (event.data.iceServers && event.data.iceServers.length > 0) {
                 this.config = this.mergeIceServers(this.config, event.data);
@@ -7,28 +7,59 @@
 
 package main
 
-// Hub maintains the set of active clients and broadcasts messages to the
-// clients.
+import (
+	"sync"
+	"time"
+)
+
+// Hub maintains the set of active clients of a single room and broadcasts
+// messages to the clients.
 type Hub struct {
+	// Name of the room this hub serves.
+	name string
+
+	// Guards clients and users.
+	mu sync.RWMutex
+
 	// Registered clients.
 	clients map[string]*Client
 
-	// Inbound messages from the clients.
-	broadcast chan []byte
+	// Nicks of logged in users in this room.
+	users []string
+
+	// Who is typing, see typing.go.
+	typing typingState
+
+	// Held while a message gets its id, is stored and sent, so the room's
+	// history and clients get ids in order.
+	post sync.Mutex
 
 	// Register requests from the clients.
 	register chan *Client
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// Clients moving to another room, their send channel stays open.
+	part chan *Client
+
+	// Closed when the room is closed, stops run.
+	quit chan struct{}
+
+	// Last time a client or user came or went, guarded by mu.
+	active time.Time
 }
 
-func newHub() *Hub {
+func newHub(name string) *Hub {
 	return &Hub{
-		broadcast:  make(chan []byte),
+		name:       name,
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		part:       make(chan *Client),
+		quit:       make(chan struct{}),
 		clients:    make(map[string]*Client),
+		typing:     typingState{nicks: make(map[string]time.Time)},
+		active:     time.Now(),
 	}
 }
 
@@ -37,28 +68,188 @@ func (h *Hub) run() {
 		select {
 		case client := <-h.register:
 			// Register a new client
+			h.mu.Lock()
 			h.clients[client.id] = client // Use the client's unique ID as the key
-			logger("DEBUG", "Client connected:", client.id)
+			h.active = time.Now()
+			h.mu.Unlock()
+			logger("DEBUG", "Client connected:", client.id, "room:", h.name)
 
 		case client := <-h.unregister:
 			// Remove client on disconnect
+			h.mu.Lock()
 			if _, ok := h.clients[client.id]; ok {
 				delete(h.clients, client.id)
 				close(client.send)
 				logger("DEBUG", "Client disconnected:", client.id)
 			}
+			h.active = time.Now()
+			h.mu.Unlock()
+
+		case client := <-h.part:
+			// Client switched rooms, keep the connection open.
+			h.mu.Lock()
+			delete(h.clients, client.id)
+			h.active = time.Now()
+			h.mu.Unlock()
+			logger("DEBUG", "Client", client.id, "left room:", h.name)
 
-		case message := <-h.broadcast:
-			// Broadcast messages to all clients
-			for _, client := range h.clients {
-				select {
-				case client.send <- message:
-				default:
-					// If client buffer is full, remove it
-					close(client.send)
-					delete(h.clients, client.id)
-				}
+		case <-h.quit:
+			logger("DEBUG", "Stopped room:", h.name)
+			return
+		}
+	}
+}
+
+// remove; Unregisters client. Fine after the room was closed, the client's
+// connection is closing anyway.
+func (h *Hub) remove(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.quit:
+	}
+}
+
+// idleFor; Returns how long the room has been empty, 0 while anyone is in it.
+func (h *Hub) idleFor() time.Duration {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.clients) > 0 || len(h.users) > 0 {
+		return 0
+	}
+	return time.Since(h.active)
+}
+
+// touch; Keeps an empty room open for a while, someone is about to enter.
+func (h *Hub) touch() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.active = time.Now()
+}
+
+// emit; Sends message to every logged in client of the room, except skip.
+// skip may be nil.
+func (h *Hub) emit(message []byte, skip *Client) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, client := range h.clients {
+		if client != skip && client.nick() != "" {
+			select {
+			case client.send <- message:
+			default:
+				logger("ERROR", "Send buffer full, dropping message for:", client.nick())
 			}
 		}
 	}
 }
+
+// client; Looks up a client of this room by id.
+func (h *Hub) client(id string) (*Client, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	client, ok := h.clients[id]
+	return client, ok
+}
+
+// loggedIn; Returns the logged in clients of the room.
+func (h *Hub) loggedIn() []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var clients []*Client
+	for _, client := range h.clients {
+		if client.nick() != "" {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// roster; Returns the room's user list with how each nick is shown. A nick
+// held for a dropped connection is idle.
+func (h *Hub) roster() []RosterEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	byNick := make(map[string]*Client, len(h.clients))
+	for _, client := range h.clients {
+		if client.nick() != "" {
+			byNick[client.nick()] = client
+		}
+	}
+
+	roster := make([]RosterEntry, 0, len(h.users))
+	for _, nick := range h.users {
+		if client, ok := byNick[nick]; ok {
+			roster = append(roster, client.rosterEntry())
+		} else if entry, ok := heldPresence(nick); ok {
+			roster = append(roster, entry)
+		} else {
+			roster = append(roster, RosterEntry{Nick: nick, State: presenceOnline})
+		}
+	}
+	return roster
+}
+
+// addUser; Adds nick to the room's user list.
+func (h *Hub) addUser(nick string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.users = append(h.users, nick)
+	h.active = time.Now()
+}
+
+// removeUser; Removes nick from the room's user list.
+func (h *Hub) removeUser(nick string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, v := range h.users {
+		if v == nick {
+			h.users = append(h.users[:i], h.users[i+1:]...)
+			break
+		}
+	}
+	h.active = time.Now()
+}
+
+// renameUser; Replaces old with nick in the room's user list, the read marker
+// of old moves along. Returns false if old is not in the room.
+func (h *Hub) renameUser(old string, nick string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, v := range h.users {
+		if v == old {
+			h.users[i] = nick
+			markers.rename(h.name, old, nick)
+			return true
+		}
+	}
+	return false
+}
+
+// hasUser; Returns true if nick is in the room's user list.
+func (h *Hub) hasUser(nick string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, v := range h.users {
+		if v == nick {
+			return true
+		}
+	}
+	return false
+}
+
+// userList; Returns a copy of the room's user list.
+func (h *Hub) userList() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]string{}, h.users...)
+}
+
+// markRead; Moves the read marker of nick forward to id.
+// Returns false if nick already read past id.
+func (h *Hub) markRead(nick string, id string) bool {
+	return markers.mark(h.name, nick, id)
+}
+
+// readMarkers; Returns a copy of the room's read markers.
+func (h *Hub) readMarkers() map[string]string {
+	return markers.room(h.name)
+}
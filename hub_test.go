@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// testClient; Returns a logged in client of hub without a connection, what
+// is sent to it is thrown away.
+func testClient(t *testing.T, hub *Hub, nick string) *Client {
+	c := &Client{id: nick, send: make(chan []byte, 256)}
+	c.setHub(hub)
+	c.setNick(nick)
+	hub.register <- c
+	hub.addUser(nick)
+	done := make(chan struct{})
+	go func() {
+		for range c.send {
+		}
+		close(done)
+	}()
+	t.Cleanup(func() {
+		hub.remove(c)
+		<-done
+	})
+	return c
+}
+
+// Run with -race, nicks change while other goroutines read them.
+func TestNickChangeWhileBroadcasting(t *testing.T) {
+	hub := newHub("race-test")
+	go hub.run()
+	t.Cleanup(func() { close(hub.quit) })
+	alice := testClient(t, hub, "alice")
+	testClient(t, hub, "bob")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		old := alice.nick()
+		for i := 0; i < 200; i++ {
+			nick := fmt.Sprint("alice", i)
+			hub.renameUser(old, nick)
+			alice.setNick(nick)
+			old = nick
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			hub.emit([]byte(`{"event":"new-msg"}`), nil)
+			hub.roster()
+			rooms.clientsByNick("alice")
+		}
+	}()
+	wg.Wait()
+
+	if got := alice.nick(); got != "alice199" {
+		t.Errorf("nick = %q, want alice199", got)
+	}
+}
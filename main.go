@@ -6,36 +6,135 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
 var address = flag.String("bind", ":8090", "bind service to address.")
 var logLevel = flag.String("log", "INFO", "Log level (DEBUG, INFO, ERROR).")
-var cache = flag.Int("cache", 0, "Message cache size.")
+var cache = flag.Int("cache", 0, "Messages of a room sent to users joining it.")
 var maxMessageSize = flag.Int64("readlimit", 1, "Maximum message size in MB.")
 var certFile = flag.String("certfile", "", "Path to a TLS certificate.")
 var keyFile = flag.String("keyfile", "", "Path to a private key path.")
-var signalingEnabled = flag.Bool("signaling", false, "Advertise to client, we provide RTC signaling.")
+var signaling = flag.Bool("signaling", false, "Advertise to client, we provide RTC signaling.")
+var storeKind = flag.String("store", "memory", "History store (memory, disk).")
+var dataDir = flag.String("datadir", "data", "Directory for persistent data.")
+var historyRetain = flag.Int("retain", 0, "Messages kept per room for edits, replies and paging, never fewer than -cache. 0 keeps all with -store disk, 1000 with -store memory.")
+var rateLimitSpec = flag.String("ratelimits", "login=0.5/5,register-nick=0.1/3,change-password=0.1/3,unregister-nick=0.1/3,change-nick=0.2/3,set-topic=0.1/3,set-presence=0.2/5,send-msg=1/10,send-dm=1/10,typing=2/10,signal=20/200,ack=20/100,read=20/100,upload=0.1/10,*=10/50", "Per client event budgets, event=rate/burst with rate in events per second, * for other events. upload is the budget of POST /upload per IP.")
+var rateKick = flag.Int("ratekick", 30, "Disconnect clients going over budget this many times in 10 seconds, 0 never does.")
+var muteTime = flag.Duration("mutetime", 5*time.Minute, "How long nicks caught spamming are muted.")
+var maxUploadSize = flag.Int64("uploadlimit", 10, "Maximum upload size in MB.")
+var nickMin = flag.Int("nickmin", 1, "Minimum nick length in characters.")
+var nickMax = flag.Int("nickmax", 24, "Maximum nick length in characters.")
+var nickPatternSpec = flag.String("nickpattern", `^[\p{L}\p{M}\p{N}_.\- ]+$`, "Regular expression nicks must match.")
+var reservedNicks = flag.String("reservednicks", "admin,administrator,system,server,moderator,root,owner", "Comma separated nicks nobody can use, look-alikes included.")
+var adminTokenFlag = flag.String("admintoken", "", "Secret for the /admin/bans endpoint, granting roles with set-role and unregistering any nick with unregister-nick or /unregister, unset disables them.")
+var resumeGrace = flag.Duration("resumegrace", time.Minute, "How long the nick of a dropped connection is held for it to resume, 0 disables resuming.")
+var rolesFile = flag.String("roles", "", "Roles file, a JSON object of nick -> owner or moderator. Defaults to <datadir>/roles.json.")
+var banFile = flag.String("bans", "", "Ban list file. Defaults to <datadir>/bans.json.")
+var trustedProxySpec = flag.String("trustedproxies", "", "Comma separated IPs and CIDR ranges of reverse proxies, their X-Forwarded-For is trusted.")
+var motdFile = flag.String("motd", "", "File with the message of the day, shown to everyone who logs in.")
+var topicMods = flag.Bool("topicmods", false, "Only moderators and owners may set room topics.")
+var idleTime = flag.Duration("idletime", 5*time.Minute, "How long a client may send nothing before it is shown as idle, 0 never does.")
+var allowedTypes = flag.String("mimetypes", "image/*,audio/*,video/*,text/plain,application/pdf,application/zip", "Comma separated mime types allowed for attachments, type/* matches a whole type.")
 
-var userlist []string          // list of users.
-var msgid int = 1              // message id.
-var messageCache []MessageData // message cache.
-var cacheSize *int = cache     // message cache size.
+// most messages sent in one history-page.
+const maxHistoryPage = 100
 
 func main() {
 	// serve static assets.
 	fs := http.FileServer(http.Dir("html"))
 	http.Handle("/", middleware(fs))
 	flag.Parse()
-	hub := newHub()
-	go hub.run()
+	setLogLevel(*logLevel)
+	if err := loadConfig(); err != nil {
+		logger("ERROR", "Invalid configuration:", err)
+		os.Exit(1)
+	}
+	if err := validateConfig(); err != nil {
+		logger("ERROR", "Invalid configuration:\n"+err.Error())
+		os.Exit(1)
+	}
+	setLogLevel(*logLevel)
+	loadReloadable()
+
+	if err := setRateLimits(*rateLimitSpec); err != nil {
+		logger("ERROR", "Invalid -ratelimits:", err)
+		os.Exit(1)
+	}
+	if err := parseTrustedProxies(*trustedProxySpec); err != nil {
+		logger("ERROR", "Invalid -trustedproxies:", err)
+		os.Exit(1)
+	}
+	if err := compileNickPattern(*nickPatternSpec); err != nil {
+		logger("ERROR", "Invalid -nickpattern:", err)
+		os.Exit(1)
+	}
+
+	var err error
+	history, err = openHistoryStore(*storeKind, *dataDir)
+	if err != nil {
+		logger("ERROR", "Failed to open history store:", err)
+		os.Exit(1)
+	}
+	defer history.Close()
+
+	accounts, err = openAccountStore(*dataDir)
+	if err != nil {
+		logger("ERROR", "Failed to open registered nicks:", err)
+		os.Exit(1)
+	}
+
+	roles, err = openRoleStore(dataFile(*rolesFile, "roles.json"))
+	if err != nil {
+		logger("ERROR", "Failed to open roles:", err)
+		os.Exit(1)
+	}
+
+	bans, err = openBanList(dataFile(*banFile, "bans.json"))
+	if err != nil {
+		logger("ERROR", "Failed to open bans:", err)
+		os.Exit(1)
+	}
+
+	// the memory store starts its ids over, saved markers would be ahead.
+	readsPath := ""
+	if *storeKind == "disk" {
+		readsPath = dataFile("", "reads.json")
+	}
+	markers, err = openReadStore(readsPath)
+	if err != nil {
+		logger("ERROR", "Failed to open read markers:", err)
+		os.Exit(1)
+	}
+
+	topics, err = openTopicStore(*dataDir)
+	if err != nil {
+		logger("ERROR", "Failed to open topics:", err)
+		os.Exit(1)
+	}
+
+	text, err := loadMOTD(*motdFile)
+	if err != nil {
+		logger("ERROR", "Failed to read -motd:", err)
+		os.Exit(1)
+	}
+	motd.Store(text)
+
+	hub := rooms.get(defaultRoom)
 	events := NewEventManager()
+	commands := NewCommandManager()
+	// built-in slash commands, add your own with commands.On.
+	registerCommands(commands, events)
 	logger("INFO", "Starting server on", *address)
 	msg := "disabled"
-	if *signalingEnabled {
+	if signalingEnabled.Load() {
 		msg = "enabled"
 	}
 	logger("INFO", "RTC signaling is", msg)
@@ -49,86 +148,510 @@ func main() {
 			return
 		}
 
-		if loginData.Nick == "" {
-			forceLogin(c, "Nick can't be empty.")
+		if c.nick() != "" {
+			logger("DEBUG", "Ignoring 'login' event: already logged in as", c.nick())
+			return
+		}
+
+		nick, err := normalizeNick(loginData.Nick)
+		if err != nil {
+			forceLogin(c, err.Error())
+			return
+		}
+		// banned nicks and IPs stay out.
+		if ban, banned := bans.nickBan(nick); banned {
+			forceLogin(c, ban.String())
+			return
+		}
+		if ban, banned := bans.ipBan(c.ip); banned {
+			forceLogin(c, ban.String())
 			return
 		}
 		// check if user in.
-		if checkIfUserIn(loginData.Nick) {
+		if checkIfUserIn(nick) {
+			forceLogin(c, "This nick is already in chat.")
+			return
+		}
+		// registered nicks need their password.
+		if accounts.registered(nick) {
+			if loginData.Password == "" {
+				sendEvent(c, "login-password", "This nick is registered, log in with its password.")
+				return
+			}
+			registeredNick, err := accounts.verify(nick, loginData.Password)
+			if err != nil {
+				logger("INFO", "Failed login as", nick, "from", c.ip)
+				sendEvent(c, "login-password", err.Error())
+				return
+			}
+			// show it the way it was registered.
+			nick = registeredNick
+		}
+
+		// save nick and enter the default room, unless it was taken meanwhile.
+		nickMu.Lock()
+		defer nickMu.Unlock()
+		if checkIfUserIn(nick) {
 			forceLogin(c, "This nick is already in chat.")
 			return
 		}
+		c.setNick(nick)
+		enterRoom(c, c.hub())
+	})
 
-		// now add the user to the list.
-		userlist = append(userlist, loginData.Nick)
-		logger("DEBUG", "Updated users list:", userlist)
+	// change the nick of a logged in client, without leaving the room.
+	events.On("change-nick", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			forceLogin(c, "You need to be logged in to change your nick.")
+			return
+		}
+		var req EventData
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse change-nick data:", err)
+			return
+		}
 
-		// Tell this user who is already in.
-		startEvent := Event{
-			Event: "start",
-			Data: EventData{
-				Users: userlist,
-			},
+		nick, err := normalizeNick(req.Nick)
+		if err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		if nick == c.nick() {
+			return
+		}
+		// a mute sticks to the nick, don't let it be shed.
+		if left, _ := mutedFor(c.nick()); left > 0 {
+			sendError(c, fmt.Sprintf("You can't change your nick while muted, %s left.", left.Round(time.Second)))
+			return
+		}
+		if ban, banned := bans.nickBan(nick); banned {
+			sendError(c, ban.String())
+			return
+		}
+		// a look-alike of the own nick is the same nick, e.g. a new case.
+		self := sameNick(nick, c.nick())
+		if !self && checkIfUserIn(nick) {
+			sendError(c, "This nick is already in chat.")
+			return
+		}
+		if accounts.registered(nick) {
+			if self {
+				sendError(c, "A registered nick keeps the spelling it was registered with.")
+				return
+			}
+			if req.Password == "" {
+				sendEvent(c, "nick-password", NickChange{Nick: nick, Reason: "This nick is registered, enter its password."})
+				return
+			}
+			registeredNick, err := accounts.verify(nick, req.Password)
+			if err != nil {
+				logger("INFO", "Failed nick change to", nick, "from", c.ip)
+				sendEvent(c, "nick-password", NickChange{Nick: nick, Reason: err.Error()})
+				return
+			}
+			nick = registeredNick
+		}
+
+		nickMu.Lock()
+		defer nickMu.Unlock()
+		if !self && checkIfUserIn(nick) {
+			sendError(c, "This nick is already in chat.")
+			return
 		}
+		old := c.nick()
+		c.hub().setTyping(old, false)
+		c.hub().renameUser(old, nick)
+		renameSpam(old, nick)
+		c.setNick(nick)
+		logger("INFO", old, "is now", nick, "in", c.hub().name)
 
-		startEventJSON, err := json.Marshal(startEvent)
+		changedEventJSON, err := json.Marshal(Event{Event: "nick-changed", Data: NickChange{Old: old, Nick: nick, Role: roles.role(nick)}})
 		if err != nil {
-			logger("ERROR", "Failed to encode start event:", err)
+			logger("ERROR", "Failed to encode nick-changed event:", err)
 			return
 		}
+		c.hub().emit(changedEventJSON, nil)
+	})
 
-		logger("DEBUG", "Emitting start event:", string(startEventJSON))
-		c.send <- startEventJSON
+	// register the nick of the client, it then needs the password to log in.
+	events.On("register-nick", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			forceLogin(c, "You need to be logged in to register your nick.")
+			return
+		}
+		var req AccountRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse register-nick data:", err)
+			return
+		}
 
-		// tell everyone "user" entered.
-		userEnteredEvent := Event{
-			Event: "ue",
-			Data: EventData{
-				Nick: loginData.Nick,
-			},
+		if err := accounts.register(c.nick(), req.Password); err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		logger("INFO", "Registered nick", c.nick())
+		sendEvent(c, "nick-registered", EventData{Nick: c.nick()})
+	})
+
+	// change the password of the own registered nick.
+	events.On("change-password", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			forceLogin(c, "You need to be logged in to change your password.")
+			return
+		}
+		var req AccountRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse change-password data:", err)
+			return
+		}
+
+		if _, err := accounts.verify(c.nick(), req.Password); err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		if err := accounts.setPassword(c.nick(), req.NewPassword); err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		logger("INFO", "Changed password of", c.nick())
+		sendEvent(c, "password-changed", EventData{Nick: c.nick()})
+	})
+
+	// drop a registration, the own one with its password or any with -admintoken.
+	events.On("unregister-nick", func(c *Client, data []byte) {
+		var req AccountRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse unregister-nick data:", err)
+			return
+		}
+
+		if req.Token != "" {
+			if !adminToken(req.Token) {
+				logger("INFO", "Bad admin token from", c.ip)
+				sendError(c, "Wrong admin token.")
+				return
+			}
+		} else {
+			if c.nick() == "" {
+				forceLogin(c, "You need to be logged in to unregister your nick.")
+				return
+			}
+			req.Nick = c.nick()
+			if _, err := accounts.verify(req.Nick, req.Password); err != nil {
+				sendError(c, err.Error())
+				return
+			}
+		}
+
+		if err := accounts.unregister(req.Nick); err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		// whoever registers it next does not inherit the role.
+		if err := roles.setRole(req.Nick, roleUser); err != nil {
+			logger("ERROR", "Failed to drop the role of", req.Nick)
+		}
+		logger("INFO", "Unregistered nick", req.Nick)
+		sendEvent(c, "nick-unregistered", EventData{Nick: req.Nick})
+	})
+
+	// throw a nick out, it may log in again.
+	events.On("kick", func(c *Client, data []byte) {
+		var req ModerationRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse kick data:", err)
+			return
+		}
+		nick, err := moderationTarget(c, req.Nick)
+		if err != nil {
+			sendError(c, err.Error())
+			return
+		}
+
+		reason := "You were kicked by " + c.nick()
+		if req.Reason != "" {
+			reason += ": " + req.Reason
+		}
+		hubs := throwOut(nick, "", closeKicked, reason)
+		if len(hubs) == 0 {
+			sendError(c, nick+" is not in chat.")
+			return
+		}
+		logger("INFO", c.nick(), "kicked", nick, "reason:", req.Reason)
+		moderationNotice(c, hubs, withReason(nick+" was kicked by "+c.nick(), req.Reason))
+	})
+
+	// ban a nick and the IPs it is connected from, or an IP.
+	events.On("ban", func(c *Client, data []byte) {
+		var req ModerationRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse ban data:", err)
+			return
+		}
+		if !isModerator(c) {
+			sendError(c, "Only moderators can do that.")
+			return
+		}
+		d, err := parseBanDuration(req.Duration, 0)
+		if err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		ban := Ban{Reason: req.Reason, By: c.nick()}
+		if d > 0 {
+			ban.Until = time.Now().Add(d).UTC()
+		}
+
+		var added []Ban
+		target := req.IP
+		if req.Nick != "" {
+			nick, err := moderationTarget(c, req.Nick)
+			if err != nil {
+				sendError(c, err.Error())
+				return
+			}
+			target = nick
+			nickBan := ban
+			nickBan.Nick = nick
+			added = append(added, nickBan)
+			for _, client := range rooms.clientsByNick(nick) {
+				// sharing the moderator's IP, banning it would lock them out too.
+				if client.ip == c.ip {
+					continue
+				}
+				ipBan := ban
+				ipBan.IP = client.ip
+				added = append(added, ipBan)
+			}
+		}
+		if req.IP != "" {
+			ip, err := normalizeBanIP(req.IP)
+			if err != nil {
+				sendError(c, err.Error())
+				return
+			}
+			if ipInRange(c.ip, ip) {
+				sendError(c, "You can't do that to yourself.")
+				return
+			}
+			target = ip
+			ipBan := ban
+			ipBan.IP = ip
+			added = append(added, ipBan)
+		}
+		if len(added) == 0 {
+			sendError(c, "Name a nick or an IP to ban.")
+			return
+		}
+
+		if err := bans.add(added...); err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		var hubs []*Hub
+		for _, b := range added {
+			hubs = append(hubs, throwOut(b.Nick, b.IP, closeBanned, b.String())...)
+		}
+		logger("INFO", c.nick(), "banned", target, forDuration(d), "reason:", req.Reason)
+		moderationNotice(c, hubs, withReason(target+" was banned "+forDuration(d)+" by "+c.nick(), req.Reason))
+	})
+
+	events.On("unban", func(c *Client, data []byte) {
+		var req ModerationRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse unban data:", err)
+			return
+		}
+		if !isModerator(c) {
+			sendError(c, "Only moderators can do that.")
+			return
+		}
+
+		if req.IP != "" {
+			ip, err := normalizeBanIP(req.IP)
+			if err != nil {
+				sendError(c, err.Error())
+				return
+			}
+			req.IP = ip
+		}
+		removed, err := bans.remove(req.Nick, req.IP)
+		if err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		target := req.Nick
+		if target == "" {
+			target = req.IP
+		}
+		if removed == 0 {
+			sendError(c, target+" is not banned.")
+			return
+		}
+		logger("INFO", c.nick(), "unbanned", target)
+		roomNotice(c.hub(), target+" was unbanned by "+c.nick()+".")
+	})
+
+	events.On("mute", func(c *Client, data []byte) {
+		var req ModerationRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse mute data:", err)
+			return
+		}
+		nick, err := moderationTarget(c, req.Nick)
+		if err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		d, err := parseBanDuration(req.Duration, *muteTime)
+		if err != nil || d == 0 {
+			sendError(c, "Invalid duration, use e.g. 10m or 2h.")
+			return
+		}
+
+		reason := "muted by " + c.nick()
+		if req.Reason != "" {
+			reason += ", " + req.Reason
+		}
+		muteNick(nick, d, reason)
+		logger("INFO", c.nick(), "muted", nick, "for", d, "reason:", req.Reason)
+		moderationNotice(c, roomsOf(nick), withReason(nick+" was muted for "+d.String()+" by "+c.nick(), req.Reason))
+	})
+
+	events.On("unmute", func(c *Client, data []byte) {
+		var req ModerationRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse unmute data:", err)
+			return
+		}
+		nick, err := moderationTarget(c, req.Nick)
+		if err != nil {
+			sendError(c, err.Error())
+			return
 		}
 
-		userEnteredJSON, err := json.Marshal(userEnteredEvent)
+		if !unmuteNick(nick) {
+			sendError(c, nick+" is not muted.")
+			return
+		}
+		logger("INFO", c.nick(), "unmuted", nick)
+		moderationNotice(c, roomsOf(nick), nick+" was unmuted by "+c.nick()+".")
+	})
+
+	// grant a role, owners may, and anyone with -admintoken.
+	events.On("set-role", func(c *Client, data []byte) {
+		var req ModerationRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse set-role data:", err)
+			return
+		}
+
+		if req.Token != "" {
+			if !adminToken(req.Token) {
+				logger("INFO", "Bad admin token from", c.ip)
+				sendError(c, "Wrong admin token.")
+				return
+			}
+		} else if c.nick() == "" || roles.role(c.nick()) != roleOwner {
+			sendError(c, "Only owners can do that.")
+			return
+		}
+		nick, err := normalizeNick(req.Nick)
 		if err != nil {
-			logger("ERROR", "Failed to encode user entered event:", err)
+			sendError(c, err.Error())
+			return
+		}
+		if !accounts.registered(nick) {
+			sendError(c, nick+" needs to be registered first.")
+			return
+		}
+
+		if err := roles.setRole(nick, req.Role); err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		logger("INFO", "Role of", nick, "set to", req.Role, "by", c.nick())
+		for _, hub := range roomsOf(nick) {
+			roomNotice(hub, nick+" is "+req.Role+" now.")
+		}
+		if c.nick() != "" && !c.hub().hasUser(nick) {
+			roomNotice(c.hub(), nick+" is "+req.Role+" now.")
+		}
+	})
+
+	// set the own presence, shown to the room.
+	events.On("set-presence", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			forceLogin(c, "You need to be logged in to set your presence.")
+			return
+		}
+		var req PresenceRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse set-presence data:", err)
 			return
 		}
 
-		// save nick.
-		c.nick = loginData.Nick
-		// emit to everyone except "user".
-		for _, client := range c.hub.clients {
-			if client != c && client.nick != "" {
-				client.send <- userEnteredJSON
+		state, status, err := parsePresence(req.State, req.Status)
+		if err != nil {
+			sendError(c, err.Error())
+			return
+		}
+		// the status text is shown to the room, muted nicks keep the one they had.
+		if _, current := c.chosenPresence(); status != current {
+			if left, reason := mutedFor(c.nick()); left > 0 {
+				sendError(c, fmt.Sprintf("You are muted for %s: %s.", left.Round(time.Second), reason))
+				return
 			}
 		}
-		// send message cache to "user".
-		cacheEvent := MessageCacheResponse{
-			Event: "previous-msg",
-			Msgs:  messageCache,
+		c.setPresence(state, status)
+		logger("DEBUG", c.nick(), "is", state, status)
+		announcePresence(c.hub(), c.rosterEntry())
+	})
+
+	// set the topic of the own room, an empty text clears it.
+	events.On("set-topic", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			forceLogin(c, "You need to be logged in to set the topic.")
+			return
+		}
+		var req Topic
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse set-topic data:", err)
+			return
+		}
+
+		if *topicMods && !isModerator(c) {
+			sendError(c, "Only moderators can set the topic.")
+			return
+		}
+		if left, reason := mutedFor(c.nick()); left > 0 {
+			sendError(c, fmt.Sprintf("You are muted for %s: %s.", left.Round(time.Second), reason))
+			return
 		}
 
-		// dont return nil to the client, give empty array.
-		if cacheEvent.Msgs == nil {
-			cacheEvent.Msgs = []MessageData{}
+		topic, err := topics.setTopic(c.hub().name, req.Text, c.nick())
+		if err != nil {
+			sendError(c, err.Error())
+			return
 		}
+		logger("INFO", c.nick(), "set the topic of", c.hub().name)
 
-		cacheJSON, err := json.Marshal(cacheEvent)
+		topicEventJSON, err := json.Marshal(Event{Event: "topic-changed", Data: topic})
 		if err != nil {
-			logger("ERROR", "Failed to encode message cache:", err)
+			logger("ERROR", "Failed to encode topic-changed event:", err)
 			return
 		}
-		logger("DEBUG", "Emitting previous-msgs event for:", c.nick, "with", len(messageCache), "messages")
-		c.send <- cacheJSON
+		c.hub().emit(topicEventJSON, nil)
 	})
 
 	events.On("send-msg", func(c *Client, data []byte) {
 		// if logged in.
-		if c.nick == "" {
+		if c.nick() == "" {
 			forceLogin(c, "You need to be logged in to send a message.")
 			logger("INFO", "Ignoring 'send-msg' event: no nickname assigned.")
 			return
 		}
+		c.hub().setTyping(c.nick(), false)
 
 		logger("DEBUG", "Raw data received:", string(data[:]))
 		// structure to decode the incoming message.
@@ -140,110 +663,534 @@ func main() {
 
 		logger("DEBUG", "Message content:", incomingMessage.M.Text)
 
-		msgData := MessageData{
-			From: c.nick,
-			ID:   fmt.Sprintf("msg_%d", msgid),
-			M:    incomingMessage.M,
+		// slash commands, "//" sends a literal "/".
+		if text := incomingMessage.M.Text; strings.HasPrefix(text, "/") && incomingMessage.M.Url == "" {
+			if !strings.HasPrefix(text, "//") {
+				commands.Run(c, text)
+				return
+			}
+			incomingMessage.M.Text = text[1:]
 		}
 
-		outgoingMessage := Event{
-			Event: "new-msg",
+		postMessage(c, incomingMessage)
+	})
+
+	// edit the text of an own message.
+	events.On("edit-msg", func(c *Client, data []byte) {
+		var edit MessageData
+		if err := json.Unmarshal(data, &edit); err != nil {
+			logger("ERROR", "Failed to parse edit-msg data:", err)
+			return
+		}
+
+		historyMu.Lock()
+		defer historyMu.Unlock()
+		msgData, ok := editableMessage(c, edit.ID, false)
+		if !ok {
+			return
+		}
+		// muted nicks can't rewrite what they said either.
+		if left, reason := mutedFor(c.nick()); left > 0 {
+			sendError(c, fmt.Sprintf("You are muted for %s: %s.", left.Round(time.Second), reason))
+			return
+		}
+		if strings.TrimSpace(edit.M.Text) == "" && msgData.M.Url == "" {
+			sendError(c, "Message can't be empty, delete it instead.")
+			return
+		}
+
+		msgData.M.Text = edit.M.Text
+		msgData.Edited = true
+		if err := history.Update(c.hub().name, msgData); err != nil {
+			logger("ERROR", "Failed to store edited message:", err)
+			return
+		}
+
+		editedEvent := Event{
+			Event: "msg-edited",
 			Data:  msgData,
 		}
 
-		msgid++ // Increment msgid.
+		editedJSON, err := json.Marshal(editedEvent)
+		if err != nil {
+			logger("ERROR", "Failed to encode msg-edited event:", err)
+			return
+		}
+		logger("INFO", c.nick(), "edited", msgData.ID, "in", c.hub().name)
+		c.hub().emit(editedJSON, nil)
+	})
+
+	// delete a message, a tombstone stays in history.
+	events.On("delete-msg", func(c *Client, data []byte) {
+		var deletion MessageData
+		if err := json.Unmarshal(data, &deletion); err != nil {
+			logger("ERROR", "Failed to parse delete-msg data:", err)
+			return
+		}
+
+		historyMu.Lock()
+		defer historyMu.Unlock()
+		msgData, ok := editableMessage(c, deletion.ID, true)
+		if !ok {
+			return
+		}
+
+		msgData.M = Message{}
+		msgData.Edited = false
+		msgData.Deleted = true
+		msgData.Reactions = nil
+		if err := history.Update(c.hub().name, msgData); err != nil {
+			logger("ERROR", "Failed to store deleted message:", err)
+			return
+		}
+
+		deletedEvent := Event{
+			Event: "msg-deleted",
+			Data: MessageData{
+				From:    msgData.From,
+				ID:      msgData.ID,
+				Deleted: true,
+			},
+		}
+
+		deletedJSON, err := json.Marshal(deletedEvent)
+		if err != nil {
+			logger("ERROR", "Failed to encode msg-deleted event:", err)
+			return
+		}
+		logger("INFO", c.nick(), "deleted", msgData.ID, "in", c.hub().name)
+		c.hub().emit(deletedJSON, nil)
+	})
+
+	// toggle a reaction on a message of the room.
+	events.On("react", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			logger("INFO", "Ignoring 'react' event: no nickname assigned.")
+			return
+		}
+
+		var reaction ReactionData
+		if err := json.Unmarshal(data, &reaction); err != nil {
+			logger("ERROR", "Failed to parse react data:", err)
+			return
+		}
+
+		if !validReaction(reaction.Emoji) {
+			sendError(c, "Reactions must be a single emoji.")
+			return
+		}
+		if left, reason := mutedFor(c.nick()); left > 0 {
+			sendError(c, fmt.Sprintf("You are muted for %s: %s.", left.Round(time.Second), reason))
+			return
+		}
+
+		historyMu.Lock()
+		defer historyMu.Unlock()
+		msgData, found, err := history.Get(c.hub().name, reaction.ID)
+		if err != nil {
+			logger("ERROR", "Failed to load message", reaction.ID+":", err)
+			return
+		}
+		if !found || msgData.Deleted {
+			sendError(c, "Message not found, it may be too old to react to.")
+			return
+		}
+
+		toggleReaction(&msgData, reaction.Emoji, c.nick())
+		if err := history.Update(c.hub().name, msgData); err != nil {
+			logger("ERROR", "Failed to store reaction:", err)
+			return
+		}
+
+		reactionEvent := Event{
+			Event: "reaction-update",
+			Data: ReactionData{
+				ID:        msgData.ID,
+				Reactions: msgData.Reactions,
+			},
+		}
+
+		reactionJSON, err := json.Marshal(reactionEvent)
+		if err != nil {
+			logger("ERROR", "Failed to encode reaction-update event:", err)
+			return
+		}
+		logger("DEBUG", c.nick(), "reacted", reaction.Emoji, "to", msgData.ID)
+		c.hub().emit(reactionJSON, nil)
+	})
+
+	// a message reached the client, tell its sender.
+	events.On("ack", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			return
+		}
+
+		var ack MessageData
+		if err := json.Unmarshal(data, &ack); err != nil {
+			logger("ERROR", "Failed to parse ack data:", err)
+			return
+		}
+
+		msgData, found, err := history.Get(c.hub().name, ack.ID)
+		if err != nil || !found || msgData.From == c.nick() {
+			return
+		}
+
+		receiptEvent := Event{
+			Event: "receipt",
+			Data: ReceiptData{
+				Nick: c.nick(),
+				ID:   msgData.ID,
+				Kind: "delivered",
+			},
+		}
 
-		if newMessageJSON, err := json.Marshal(outgoingMessage); err == nil {
-			logger("DEBUG", "send-msg event triggered for:", c.nick)
-			// broadcast to all, except clients without nick
-			for _, client := range c.hub.clients {
-				if client.nick != "" {
-					client.send <- newMessageJSON
+		receiptJSON, err := json.Marshal(receiptEvent)
+		if err != nil {
+			logger("ERROR", "Failed to encode receipt event:", err)
+			return
+		}
+
+		c.hub().mu.RLock()
+		for _, client := range c.hub().clients {
+			if client.nick() == msgData.From {
+				select {
+				case client.send <- receiptJSON:
+				default:
 				}
 			}
-			// adds message to cache, pushes out old messages over limit.
-			addMessage(msgData)
-		} else {
-			logger("ERROR", "Failed to encode new-msg event:", err)
 		}
+		c.hub().mu.RUnlock()
 	})
 
-	// typing event.
-	events.On("typing", func(c *Client, data []byte) {
-		var typingStatus bool
-		// ignore.
-		if c.nick == "" {
-			logger("INFO", "Ignoring 'typing' event: no nickname assigned.")
+	// the client has seen the room up to a message.
+	events.On("read", func(c *Client, data []byte) {
+		if c.nick() == "" {
 			return
 		}
 
-		err := json.Unmarshal(data, &typingStatus)
+		var read MessageData
+		if err := json.Unmarshal(data, &read); err != nil {
+			logger("ERROR", "Failed to parse read data:", err)
+			return
+		}
+
+		if parseMessageID(read.ID) < 0 || !c.hub().markRead(c.nick(), read.ID) {
+			return
+		}
+
+		receiptEvent := Event{
+			Event: "receipt",
+			Data: ReceiptData{
+				Nick: c.nick(),
+				ID:   read.ID,
+				Kind: "read",
+			},
+		}
+
+		receiptJSON, err := json.Marshal(receiptEvent)
 		if err != nil {
-			logger("ERROR", "Failed to parse typing event:", err)
+			logger("ERROR", "Failed to encode receipt event:", err)
+			return
+		}
+		logger("DEBUG", c.nick(), "read", c.hub().name, "up to", read.ID)
+		c.hub().emit(receiptJSON, nil)
+	})
+
+	// older messages of the room, for scrolling back.
+	events.On("fetch-history", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			logger("INFO", "Ignoring 'fetch-history' event: no nickname assigned.")
 			return
 		}
 
-		typingEvent := Event{
-			Event: "typing",
-			Data: EventData{
-				Status: typingStatus,
-				Nick:   c.nick,
+		var request HistoryRequest
+		if err := json.Unmarshal(data, &request); err != nil {
+			logger("ERROR", "Failed to parse fetch-history data:", err)
+			return
+		}
+
+		if request.Limit <= 0 || request.Limit > maxHistoryPage {
+			request.Limit = maxHistoryPage
+		}
+		if request.Before != "" && parseMessageID(request.Before) < 0 {
+			sendError(c, "Unknown message id: "+request.Before)
+			return
+		}
+
+		msgs, hasMore, err := history.Before(c.hub().name, request.Before, request.Limit)
+		if err != nil {
+			logger("ERROR", "Failed to load history of", c.hub().name+":", err)
+			return
+		}
+
+		pageEvent := Event{
+			Event: "history-page",
+			Data: HistoryPage{
+				Msgs:    msgs,
+				HasMore: hasMore,
 			},
 		}
 
-		typingJSON, err := json.Marshal(typingEvent)
+		pageJSON, err := json.Marshal(pageEvent)
 		if err != nil {
-			logger("ERROR", "Failed to encode typing event:", err)
+			logger("ERROR", "Failed to encode history-page event:", err)
+			return
+		}
+		logger("DEBUG", "Emitting history-page for:", c.nick(), "with", len(msgs), "messages before", request.Before)
+		c.send <- pageJSON
+	})
+
+	// a message with all replies to it.
+	events.On("fetch-thread", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			logger("INFO", "Ignoring 'fetch-thread' event: no nickname assigned.")
 			return
 		}
 
-		// Broadcast to all clients except the sender.
-		for _, client := range c.hub.clients {
-			if client != c && client.nick != "" {
-				client.send <- typingJSON
+		var request MessageData
+		if err := json.Unmarshal(data, &request); err != nil {
+			logger("ERROR", "Failed to parse fetch-thread data:", err)
+			return
+		}
+
+		parent, found, err := history.Get(c.hub().name, request.ID)
+		if err != nil {
+			logger("ERROR", "Failed to load message", request.ID+":", err)
+			return
+		}
+		if !found {
+			sendError(c, "Message not found, it may be too old.")
+			return
+		}
+		// asked for a reply, answer with its whole thread.
+		if parent.ReplyTo != "" {
+			if root, found, err := history.Get(c.hub().name, parent.ReplyTo); err == nil && found {
+				parent = root
 			}
 		}
 
+		threadReplies, err := history.Replies(c.hub().name, parent.ID)
+		if err != nil {
+			logger("ERROR", "Failed to load replies to", parent.ID+":", err)
+			return
+		}
+
+		threadEvent := Event{
+			Event: "thread",
+			Data: ThreadData{
+				Parent:  parent,
+				Replies: threadReplies,
+			},
+		}
+
+		threadJSON, err := json.Marshal(threadEvent)
+		if err != nil {
+			logger("ERROR", "Failed to encode thread event:", err)
+			return
+		}
+		c.send <- threadJSON
+	})
+
+	// direct message, delivered to the target's clients only.
+	events.On("send-dm", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			forceLogin(c, "You need to be logged in to send a message.")
+			logger("INFO", "Ignoring 'send-dm' event: no nickname assigned.")
+			return
+		}
+
+		var incomingMessage MessageData
+		if err := json.Unmarshal(data, &incomingMessage); err != nil {
+			logger("ERROR", "Failed to parse direct message data:", err)
+			return
+		}
+
+		if left, reason := mutedFor(c.nick()); left > 0 {
+			sendError(c, fmt.Sprintf("You are muted for %s: %s.", left.Round(time.Second), reason))
+			return
+		}
+
+		if incomingMessage.To == "" || incomingMessage.To == c.nick() {
+			sendError(c, "Direct messages need another user's nick.")
+			return
+		}
+
+		if !checkAttachment(c, &incomingMessage.M) {
+			return
+		}
+
+		targets := rooms.clientsByNick(incomingMessage.To)
+		if len(targets) == 0 {
+			sendError(c, incomingMessage.To+" is not online.")
+			return
+		}
+		// the nick the way it is in chat.
+		to := targets[0].nick()
+		if to == c.nick() {
+			sendError(c, "Direct messages need another user's nick.")
+			return
+		}
+
+		id, err := history.NextID()
+		if err != nil {
+			logger("ERROR", "Failed to allocate message id:", err)
+			return
+		}
+
+		msgData := MessageData{
+			From: c.nick(),
+			To:   to,
+			ID:   id,
+			M:    incomingMessage.M,
+		}
+
+		outgoingMessage := Event{
+			Event: "new-dm",
+			Data:  msgData,
+		}
+
+		newDmJSON, err := json.Marshal(outgoingMessage)
+		if err != nil {
+			logger("ERROR", "Failed to encode new-dm event:", err)
+			return
+		}
+
+		logger("DEBUG", "send-dm event triggered for:", c.nick(), "to:", to)
+		// not kept in history, the files are kept a while after each send.
+		touchBlobs(msgData.M)
+		if rooms.sendToNick(to, newDmJSON) == 0 {
+			sendError(c, to+" is not online.")
+			return
+		}
+		// echo to the sender.
+		c.send <- newDmJSON
+	})
+
+	// typing event.
+	events.On("typing", func(c *Client, data []byte) {
+		var typingStatus bool
+		// ignore.
+		if c.nick() == "" {
+			logger("INFO", "Ignoring 'typing' event: no nickname assigned.")
+			return
+		}
+
+		err := json.Unmarshal(data, &typingStatus)
+		if err != nil {
+			logger("ERROR", "Failed to parse typing event:", err)
+			return
+		}
+
+		// the room hears of it with the next typing-list.
+		c.hub().setTyping(c.nick(), typingStatus)
+
 		// Log the event.
 		action := "is"
 		if !typingStatus {
 			action = "is not"
 		}
-		logger("INFO", c.nick, action, "Typing.")
+		logger("DEBUG", c.nick(), action, "Typing.")
 	})
 
 	// We dont really need to trigger this in events, but possible logout process in future? could be useful
 	events.On("disconnect", func(c *Client, data []byte) {
-		if c.nick != "" {
-			logger("DEBUG", "Disconnecting client:", c.nick)
-			// remove "user" from the list.
-			for i, v := range userlist {
-				if v == c.nick {
-					userlist = append(userlist[:i], userlist[i+1:]...)
-					break
+		if c.nick() != "" {
+			logger("DEBUG", "Disconnecting client:", c.nick())
+			c.hub().setTyping(c.nick(), false)
+			// keep "user" in the room for a while, it may resume.
+			if holdSession(c) {
+				c.hub().remove(c)
+				// not if another connection resumed it already.
+				if entry, ok := heldPresence(c.nick()); ok {
+					announcePresence(c.hub(), entry)
 				}
-			}
-			// Tell everyone, "user" left.
-			userLeftEvent := Event{
-				Event: "ul",
-				Data: EventData{
-					Nick: c.nick,
-				},
-			}
-
-			userLeftJson, err := json.Marshal(userLeftEvent)
-			if err != nil {
-				logger("ERROR", "Failed to encode user left event:", err)
 				return
 			}
+			// remove "user" from the room and tell everyone.
+			leaveRoom(c, true)
+		}
+	})
+
+	// take over the session of a dropped connection.
+	events.On("resume", func(c *Client, data []byte) {
+		if c.nick() != "" {
+			logger("DEBUG", "Ignoring 'resume' event: already logged in as", c.nick())
+			return
+		}
+		var req ResumeRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger("ERROR", "Failed to parse resume data:", err)
+			return
+		}
+
+		nick, hub, err := takeSession(c, req.Token)
+		if err != nil {
+			logger("DEBUG", "Resume failed:", err)
+			sendEvent(c, "resume-failed", "Your session expired, log in again.")
+			return
+		}
+		c.setNick(nick)
+		logger("INFO", nick, "resumed in", hub.name)
+		resumeRoom(c, hub, req.LastID)
+		announcePresence(hub, c.rosterEntry())
+	})
+
+	events.On("join-room", func(c *Client, data []byte) {
+		if c.nick() == "" {
+			forceLogin(c, "You need to be logged in to join a room.")
+			return
+		}
+
+		var roomData EventData
+		if err := json.Unmarshal(data, &roomData); err != nil {
+			logger("ERROR", "Failed to parse join-room data:", err)
+			return
+		}
+
+		name, ok := normalizeRoomName(roomData.Room)
+		if !ok {
+			sendError(c, "Room names are 1-32 characters of a-z, 0-9, - and _.")
+			return
+		}
+		if name == c.hub().name {
+			return
+		}
 
-			c.hub.broadcast <- userLeftJson
+		logger("INFO", c.nick(), "moves from", c.hub().name, "to", name)
+		leaveRoom(c, false)
+		enterRoom(c, rooms.get(name))
+	})
+
+	events.On("leave-room", func(c *Client, data []byte) {
+		if c.nick() == "" || c.hub().name == defaultRoom {
+			return
+		}
 
-			// Remove client from hub.
-			c.hub.unregister <- c
+		logger("INFO", c.nick(), "left", c.hub().name)
+		leaveRoom(c, false)
+		enterRoom(c, rooms.get(defaultRoom))
+	})
+
+	events.On("list-rooms", func(c *Client, data []byte) {
+		var list []RoomInfo
+		for _, hub := range rooms.all() {
+			list = append(list, RoomInfo{Name: hub.name, Users: len(hub.userList())})
+		}
+
+		roomListEvent := Event{
+			Event: "room-list",
+			Data: EventData{
+				Rooms: list,
+			},
+		}
 
-			logger("DEBUG", "Removed", c.nick, "from userlist")
+		roomListJSON, err := json.Marshal(roomListEvent)
+		if err != nil {
+			logger("ERROR", "Failed to encode room-list event:", err)
+			return
 		}
+		c.send <- roomListJSON
 	})
 
 	events.On("ping", func(c *Client, data []byte) {
@@ -261,22 +1208,8 @@ func main() {
 	})
 
 	events.On("signaling-enabled", func(c *Client, data []byte) {
-		if c.nick != "" {
-			iceServers, err := executeCommandFromFile()
-			if err != nil {
-				logger("ERROR", "Failed to execute command from file.", err)
-			}
-			eventData := EventData{
-				Enabled:    *signalingEnabled,
-				IceServers: iceServers,
-			}
-
-			availableEvent := Event{
-				Event: "signaling-available",
-				Data:  eventData,
-			}
-
-			availableJson, err := json.Marshal(availableEvent)
+		if c.nick() != "" {
+			availableJson, err := signalingAvailable()
 			if err != nil {
 				logger("ERROR", "Failed to encode signaling-available event:", err)
 				return
@@ -288,7 +1221,7 @@ func main() {
 	})
 
 	events.On("ready", func(c *Client, data []byte) {
-		if c.nick != "" && *signalingEnabled {
+		if c.nick() != "" && signalingEnabled.Load() {
 			readyEvent := Event{
 				Event: "user-ready",
 				Data:  c.id,
@@ -301,17 +1234,12 @@ func main() {
 			}
 
 			logger("DEBUG", "user-ready response sent:", string(readyJson))
-
-			for _, client := range c.hub.clients {
-				if client != c && client.nick != "" {
-					client.send <- readyJson
-				}
-			}
+			c.hub().emit(readyJson, c)
 		}
 	})
 
 	events.On("signal", func(c *Client, data []byte) {
-		if c.nick == "" || !*signalingEnabled {
+		if c.nick() == "" || !signalingEnabled.Load() {
 			return
 		}
 
@@ -340,7 +1268,7 @@ func main() {
 		}
 
 		// Check if the target client exists before sending.
-		targetClient, exists := c.hub.clients[signalingData.Target]
+		targetClient, exists := c.hub().client(signalingData.Target)
 		if !exists {
 			logger("ERROR", "Target client not found:", signalingData.Target)
 			return
@@ -357,14 +1285,30 @@ func main() {
 		}
 	})
 
+	http.HandleFunc("/admin/bans", handleBans)
+	http.HandleFunc("/upload", handleUpload)
+	http.HandleFunc("/"+blobURLPrefix, handleFile)
+	go collectBlobs()
+	go watchIdle()
+	go watchTyping()
+	go watchRooms()
+	go watchReads()
+
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(hub, w, r, events)
 	})
 
+	go watchReload()
+
 	// Most are probably behind a proxy, but good practice to provide the option.
-	var err error
 	if *certFile != "" && *keyFile != "" {
-		err = http.ListenAndServeTLS(*address, *certFile, *keyFile, nil)
+		if err := loadCertificate(); err != nil {
+			logger("ERROR", "Failed to load the TLS certificate:", err)
+			os.Exit(1)
+		}
+		// the certificate is read again on SIGHUP, see reload.go.
+		server := &http.Server{Addr: *address, TLSConfig: &tls.Config{GetCertificate: getCertificate}}
+		err = server.ListenAndServeTLS("", "")
 	} else {
 		err = http.ListenAndServe(*address, nil)
 	}
@@ -0,0 +1,186 @@
+// File: moderation.go - Kicks, bans and room notices
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Moderators kick, ban, mute and unmute nicks of lower rank, each shows up
+//    as a notice in the rooms involved.
+//  - Bans are by nick and by IP, see bans.go.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fasthttp/websocket"
+)
+
+// Close codes sent to clients that are thrown out, the reason is in the frame.
+const (
+	closeKicked = 4000
+	closeBanned = 4001
+)
+
+// parseBanDuration; Parses the duration of a ban or mute, "" gives def.
+func parseBanDuration(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Invalid duration %q, use e.g. 10m or 2h.", s)
+	}
+	return d, nil
+}
+
+// moderationTarget; Checks that c may moderate name and returns the nick as
+// it is in chat, or normalized if it is not in.
+func moderationTarget(c *Client, name string) (string, error) {
+	if !isModerator(c) {
+		return "", errors.New("Only moderators can do that.")
+	}
+
+	nick := ""
+	for _, hub := range rooms.all() {
+		for _, user := range hub.userList() {
+			if sameNick(user, name) {
+				nick = user
+			}
+		}
+	}
+	if nick == "" {
+		normalized, err := normalizeNick(name)
+		if err != nil {
+			return "", fmt.Errorf("No such nick %q.", name)
+		}
+		nick = normalized
+	}
+
+	if sameNick(nick, c.nick()) {
+		return "", errors.New("You can't do that to yourself.")
+	}
+	if rankOf(nick) >= rankOf(c.nick()) {
+		return "", fmt.Errorf("You can't do that to %s.", nick)
+	}
+	return nick, nil
+}
+
+// throwOut; Ends the sessions of every connection of nick, or from ip or
+// range ip, and
+// closes them with code and reason. Held nicks leave right away.
+// Returns the rooms they were in.
+func throwOut(nick string, ip string, code int, reason string) []*Hub {
+	var targets []*Client
+	for _, hub := range rooms.all() {
+		hub.mu.RLock()
+		for _, client := range hub.clients {
+			if (nick != "" && client.nick() != "" && sameNick(client.nick(), nick)) || (ip != "" && ipInRange(client.ip, ip)) {
+				targets = append(targets, client)
+			}
+		}
+		hub.mu.RUnlock()
+	}
+
+	seen := make(map[*Hub]bool)
+	var left []*Hub
+	for _, client := range targets {
+		if client.nick() != "" && !seen[client.hub()] {
+			seen[client.hub()] = true
+			left = append(left, client.hub())
+		}
+		endSession(client)
+		// close frames carry at most 123 bytes of reason.
+		for len(reason) > 120 {
+			_, size := utf8.DecodeLastRuneInString(reason)
+			reason = reason[:len(reason)-size]
+		}
+		frame := websocket.FormatCloseMessage(code, reason)
+		client.conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(writeWait))
+		// readPump sees the error and leaves the room.
+		client.conn.Close()
+	}
+	if nick != "" {
+		for _, hub := range dropHeld(nick) {
+			if !seen[hub] {
+				seen[hub] = true
+				left = append(left, hub)
+			}
+		}
+	}
+	return left
+}
+
+// roomNotice; Shows text to everyone in hub.
+func roomNotice(hub *Hub, text string) {
+	noticeJSON, err := json.Marshal(Event{Event: "notice", Data: NoticeData{Text: text}})
+	if err != nil {
+		logger("ERROR", "Failed to encode notice event:", err)
+		return
+	}
+	hub.emit(noticeJSON, nil)
+}
+
+// moderationNotice; Shows text in the rooms of a moderation and the room of
+// the moderator.
+func moderationNotice(c *Client, hubs []*Hub, text string) {
+	seen := map[*Hub]bool{c.hub(): true}
+	roomNotice(c.hub(), text)
+	for _, hub := range hubs {
+		if !seen[hub] {
+			seen[hub] = true
+			roomNotice(hub, text)
+		}
+	}
+}
+
+// notifyModerators; Shows text to every moderator and owner in chat.
+func notifyModerators(text string) {
+	noticeJSON, err := json.Marshal(Event{Event: "notice", Data: NoticeData{Text: text}})
+	if err != nil {
+		logger("ERROR", "Failed to encode notice event:", err)
+		return
+	}
+	for _, hub := range rooms.all() {
+		hub.mu.RLock()
+		for _, client := range hub.clients {
+			if isModerator(client) {
+				select {
+				case client.send <- noticeJSON:
+				default:
+				}
+			}
+		}
+		hub.mu.RUnlock()
+	}
+}
+
+// roomsOf; Returns the rooms nick is in.
+func roomsOf(nick string) []*Hub {
+	var in []*Hub
+	for _, hub := range rooms.all() {
+		if hub.hasUser(nick) {
+			in = append(in, hub)
+		}
+	}
+	return in
+}
+
+// forDuration; Describes d for a notice, 0 is forever.
+func forDuration(d time.Duration) string {
+	if d == 0 {
+		return "permanently"
+	}
+	return "for " + d.String()
+}
+
+// withReason; Appends the reason of a moderation to a notice.
+func withReason(text string, reason string) string {
+	if reason == "" {
+		return text + "."
+	}
+	return text + ": " + reason
+}
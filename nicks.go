@@ -0,0 +1,124 @@
+// File: nicks.go - Nick validation, normalization and look-alike detection
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Nicks are normalized with the PRECIS nickname profile (RFC 8266), so width
+//    variants and extra spaces collapse into one form.
+//  - Uniqueness is checked on a skeleton: case folded, accents stripped and
+//    common look-alike letters (Cyrillic, Greek, digits) mapped to Latin.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+)
+
+// confusables maps letters that look like Latin ones to the Latin letter.
+// Applied after case folding, so only lower case is needed.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'һ': 'h', 'і': 'i', 'ї': 'i', 'ј': 'j',
+	'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y',
+	'х': 'x', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ь': 'b', 'г': 'r', 'п': 'n',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y', 'ω': 'w',
+	// Latin look-alikes
+	'ı': 'i', 'ɡ': 'g', 'ɩ': 'i', 'ʀ': 'r', 'ꞵ': 'b',
+	// digits and symbols
+	'0': 'o', '1': 'l', '3': 'e', '5': 's', '|': 'l', 'i': 'l', '_': '-', '.': '-',
+}
+
+var nickPattern *regexp.Regexp
+
+// nickMu is held from checking that a nick is free until it is in a room's
+// user list, so two clients can't take the same nick at once.
+var nickMu sync.Mutex
+
+// compileNickPattern; Compiles -nickpattern.
+func compileNickPattern(pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	nickPattern = re
+	return nil
+}
+
+// normalizeNick; Returns the display form of nick, or why it can't be used.
+func normalizeNick(nick string) (string, error) {
+	if strings.TrimSpace(nick) == "" {
+		return "", errors.New("Nick can't be empty.")
+	}
+	// check before normalizing, a huge nick should not cost much.
+	if len(nick) > *nickMax*utf8.UTFMax {
+		return "", fmt.Errorf("Nick can't be longer than %d characters.", *nickMax)
+	}
+
+	normalized, err := precis.Nickname.String(nick)
+	if err != nil {
+		return "", errors.New("Nick contains characters that are not allowed.")
+	}
+
+	length := utf8.RuneCountInString(normalized)
+	if length < *nickMin {
+		return "", fmt.Errorf("Nick must be at least %d characters.", *nickMin)
+	}
+	if length > *nickMax {
+		return "", fmt.Errorf("Nick can't be longer than %d characters.", *nickMax)
+	}
+	if !nickPattern.MatchString(normalized) {
+		return "", errors.New("Nick contains characters that are not allowed.")
+	}
+	if !strings.ContainsFunc(normalized, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) {
+		return "", errors.New("Nick needs at least one letter or number.")
+	}
+
+	skeleton := nickSkeleton(normalized)
+	for _, reserved := range strings.Split(*reservedNicks, ",") {
+		if reserved = strings.TrimSpace(reserved); reserved != "" && nickSkeleton(reserved) == skeleton {
+			return "", errors.New("This nick is reserved.")
+		}
+	}
+	return normalized, nil
+}
+
+// nickSkeleton; Reduces nick to a form where look-alike nicks are equal.
+func nickSkeleton(nick string) string {
+	key, err := precis.Nickname.CompareKey(nick)
+	if err != nil {
+		key = strings.ToLower(nick)
+	}
+
+	var b strings.Builder
+	for _, r := range norm.NFD.String(key) {
+		// drop accents and other combining marks.
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if mapped, ok := confusables[r]; ok {
+			r = mapped
+		}
+		if unicode.IsSpace(r) {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	// rn reads as m in most fonts.
+	return strings.ReplaceAll(b.String(), "rn", "m")
+}
+
+// sameNick; Returns true if a and b can't be told apart.
+func sameNick(a string, b string) bool {
+	return nickSkeleton(a) == nickSkeleton(b)
+}
@@ -0,0 +1,92 @@
+package main
+
+import "testing"
+
+// useNickFlags; Compiles the default -nickpattern for the test.
+func useNickFlags(t *testing.T) {
+	setFlag(t, nickMin, 1)
+	setFlag(t, nickMax, 24)
+	setFlag(t, reservedNicks, "admin,moderator")
+	if err := compileNickPattern(`^[\p{L}\p{M}\p{N}_.\- ]+$`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNormalizeNick(t *testing.T) {
+	useNickFlags(t)
+	tests := map[string]string{
+		"alice":         "alice",
+		"  Alice  ":     "Alice",
+		"ＡＬＩＣＥ":         "ALICE", // full width.
+		"bob  the  cat": "bob the cat",
+		"Zoë":           "Zoë",
+		"Jose\u0301":    "Jos\u00e9", // e and a combining accent compose.
+		"user_1.x-y":    "user_1.x-y",
+	}
+	for nick, want := range tests {
+		got, err := normalizeNick(nick)
+		if err != nil || got != want {
+			t.Errorf("normalizeNick(%q) = %q, %v, want %q", nick, got, err, want)
+		}
+	}
+}
+
+func TestNormalizeNickRejects(t *testing.T) {
+	useNickFlags(t)
+	for _, nick := range []string{
+		"",
+		"   ",
+		"a<b>",
+		"tab\there",
+		"___",
+		"-.-",
+		"abcdefghijklmnopqrstuvwxyz",
+		"admin",
+		"ADMIN",
+		"аdmin", // Cyrillic a.
+		"Mod erator",
+		"a\u200bb", // zero width space.
+	} {
+		if got, err := normalizeNick(nick); err == nil {
+			t.Errorf("normalizeNick(%q) = %q, want an error", nick, got)
+		}
+	}
+
+	setFlag(t, nickMin, 3)
+	if _, err := normalizeNick("ab"); err == nil {
+		t.Error("nick shorter than -nickmin accepted")
+	}
+}
+
+func TestSameNick(t *testing.T) {
+	same := [][2]string{
+		{"alice", "Alice"},
+		{"alice", "ALICE"},
+		{"alice", "аlice"}, // Cyrillic a.
+		{"alice", "a1ice"},
+		{"alice", "alíce"},
+		{"paypal", "pаypаl"},
+		{"modern", "modem"},
+		{"bob the cat", "bobthecat"},
+		{"x_y", "x-y"},
+		{"ｂｏｂ", "bob"},
+		{"omega", "0mega"},
+	}
+	for _, pair := range same {
+		if !sameNick(pair[0], pair[1]) {
+			t.Errorf("sameNick(%q, %q) = false, %q and %q", pair[0], pair[1], nickSkeleton(pair[0]), nickSkeleton(pair[1]))
+		}
+	}
+
+	different := [][2]string{
+		{"alice", "bob"},
+		{"alice", "alicia"},
+		{"anna", "ana"},
+		{"bob", "bobby"},
+	}
+	for _, pair := range different {
+		if sameNick(pair[0], pair[1]) {
+			t.Errorf("sameNick(%q, %q) = true, both are %q", pair[0], pair[1], nickSkeleton(pair[0]))
+		}
+	}
+}
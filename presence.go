@@ -0,0 +1,148 @@
+// File: presence.go - Online, away, busy and idle states
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Clients choose online, away or busy with set-presence, with an optional
+//    status text. Changes go to the room as a presence event.
+//  - An online client that sends nothing for -idletime is shown as idle until
+//    it does again.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	presenceOnline = "online"
+	presenceAway   = "away"
+	presenceBusy   = "busy"
+	presenceIdle   = "idle"
+
+	maxStatusLength = 100
+)
+
+// presence is the state a client chose, and when it was last active.
+type presence struct {
+	mu     sync.Mutex
+	state  string // online, away or busy, idle is never chosen.
+	status string
+	active time.Time
+	idle   bool
+}
+
+// passiveEvents don't count as activity, clients send them on their own.
+var passiveEvents = map[string]bool{
+	"ping": true,
+	"ack":  true,
+}
+
+// rosterEntry; Returns the nick of c and how it is shown to others.
+func (c *Client) rosterEntry() RosterEntry {
+	c.presence.mu.Lock()
+	defer c.presence.mu.Unlock()
+	entry := RosterEntry{Nick: c.nick(), State: c.presence.state, Status: c.presence.status}
+	if c.presence.idle && entry.State == presenceOnline {
+		entry.State = presenceIdle
+	}
+	return entry
+}
+
+// chosenPresence; Returns the state and status c chose.
+func (c *Client) chosenPresence() (string, string) {
+	c.presence.mu.Lock()
+	defer c.presence.mu.Unlock()
+	return c.presence.state, c.presence.status
+}
+
+// setPresence; Sets the chosen state and status of c, it is active now.
+func (c *Client) setPresence(state string, status string) {
+	c.presence.mu.Lock()
+	defer c.presence.mu.Unlock()
+	c.presence.state = state
+	c.presence.status = status
+	c.presence.active = time.Now()
+	c.presence.idle = false
+}
+
+// active; Notes that c sent event. A client coming back from idle is
+// announced to its room.
+func (c *Client) active(event string) {
+	if passiveEvents[event] {
+		return
+	}
+	c.presence.mu.Lock()
+	wasIdle := c.presence.idle && c.presence.state == presenceOnline
+	c.presence.active = time.Now()
+	c.presence.idle = false
+	c.presence.mu.Unlock()
+
+	if wasIdle && c.nick() != "" {
+		announcePresence(c.hub(), c.rosterEntry())
+	}
+}
+
+// goIdle; Marks c idle if it was inactive for d. Returns true if that changes
+// how it is shown, away and busy stay as they are.
+func (c *Client) goIdle(d time.Duration) bool {
+	c.presence.mu.Lock()
+	defer c.presence.mu.Unlock()
+	if c.presence.idle || time.Since(c.presence.active) < d {
+		return false
+	}
+	c.presence.idle = true
+	return c.presence.state == presenceOnline
+}
+
+// parsePresence; Checks a state and status sent with set-presence.
+func parsePresence(state string, status string) (string, string, error) {
+	state = strings.ToLower(strings.TrimSpace(state))
+	switch state {
+	case "":
+		state = presenceOnline
+	case presenceOnline, presenceAway, presenceBusy:
+	default:
+		return "", "", fmt.Errorf("Unknown state %q, use online, away or busy.", state)
+	}
+	status = strings.TrimSpace(status)
+	if utf8.RuneCountInString(status) > maxStatusLength {
+		return "", "", fmt.Errorf("Status can't be longer than %d characters.", maxStatusLength)
+	}
+	return state, status, nil
+}
+
+// announcePresence; Tells everyone in hub how entry's nick is shown now.
+func announcePresence(hub *Hub, entry RosterEntry) {
+	presenceJSON, err := json.Marshal(Event{Event: "presence", Data: entry})
+	if err != nil {
+		logger("ERROR", "Failed to encode presence event:", err)
+		return
+	}
+	hub.emit(presenceJSON, nil)
+}
+
+// watchIdle; Marks clients idle after -idletime without activity.
+func watchIdle() {
+	if *idleTime <= 0 {
+		return
+	}
+	ticker := time.NewTicker(min(*idleTime/4, 30*time.Second))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, hub := range rooms.all() {
+			for _, client := range hub.loggedIn() {
+				if client.goIdle(*idleTime) {
+					logger("DEBUG", client.nick(), "is idle")
+					announcePresence(hub, client.rosterEntry())
+				}
+			}
+		}
+	}
+}
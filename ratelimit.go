@@ -0,0 +1,176 @@
+// File: ratelimit.go - Per client rate limiting of inbound events
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Every client gets a token bucket per event name, budgets come from -ratelimits.
+//    Events without a budget of their own share the bucket of "*".
+//  - Events over budget are dropped and the client gets a rate-limited event.
+//  - Clients that keep going over budget are disconnected, see -ratekick.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rejected events are counted over this window for -ratekick.
+const rateKickWindow = 10 * time.Second
+
+// rateLimit allows rate events per second on average, and bursts of burst.
+type rateLimit struct {
+	rate  float64
+	burst float64
+}
+
+var (
+	rateLimitsMu sync.RWMutex
+	rateLimits   map[string]rateLimit
+)
+
+// parseRateLimits; Parses a -ratelimits spec such as "send-msg=1/10,*=10/50".
+// "*" is the budget of events without their own.
+func parseRateLimits(spec string) (map[string]rateLimit, error) {
+	limits := make(map[string]rateLimit)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		event, budget, ok := strings.Cut(entry, "=")
+		rateStr, burstStr, ok2 := strings.Cut(budget, "/")
+		if !ok || !ok2 || event == "" {
+			return nil, fmt.Errorf("invalid rate limit %q, expected event=rate/burst", entry)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || !(rate > 0) || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("invalid rate in %q, expected events per second above 0", entry)
+		}
+		burst, err := strconv.ParseFloat(burstStr, 64)
+		if err != nil || !(burst >= 1) || math.IsInf(burst, 0) {
+			return nil, fmt.Errorf("invalid burst in %q, expected at least 1", entry)
+		}
+		limits[strings.TrimSpace(event)] = rateLimit{rate: rate, burst: burst}
+	}
+	return limits, nil
+}
+
+// setRateLimits; Parses spec and makes it the budget of all clients.
+func setRateLimits(spec string) error {
+	limits, err := parseRateLimits(spec)
+	if err != nil {
+		return err
+	}
+	rateLimitsMu.Lock()
+	rateLimits = limits
+	rateLimitsMu.Unlock()
+	return nil
+}
+
+// limitFor; Returns the budget of event and the name of its bucket, false if
+// it is unlimited. Event names come from the client, so events falling back to
+// "*" share its bucket, made up names don't get a burst each.
+func limitFor(event string) (rateLimit, string, bool) {
+	rateLimitsMu.RLock()
+	defer rateLimitsMu.RUnlock()
+	if limit, ok := rateLimits[event]; ok {
+		return limit, event, true
+	}
+	limit, ok := rateLimits["*"]
+	return limit, "*", ok
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter holds the buckets of one client. It is only used from the
+// client's readPump, so it needs no locking. Upload budgets are per IP and
+// guarded by uploadLimitsMu.
+type RateLimiter struct {
+	buckets  map[string]*tokenBucket
+	rejected []time.Time
+}
+
+func newRateLimiter() *RateLimiter {
+	return &RateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+// allow; Takes a token for event. If there is none, returns false and how
+// long until there will be.
+func (l *RateLimiter) allow(event string) (bool, time.Duration) {
+	limit, name, ok := limitFor(event)
+	if !ok {
+		return true, 0
+	}
+
+	now := time.Now()
+	bucket, ok := l.buckets[name]
+	if !ok {
+		bucket = &tokenBucket{tokens: limit.burst, last: now}
+		l.buckets[name] = bucket
+	}
+	bucket.tokens = min(limit.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*limit.rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / limit.rate * float64(time.Second))
+	return false, wait
+}
+
+// idleFor; Returns how long since the limiter was last asked for a token.
+func (l *RateLimiter) idleFor() time.Duration {
+	var last time.Time
+	for _, bucket := range l.buckets {
+		if bucket.last.After(last) {
+			last = bucket.last
+		}
+	}
+	return time.Since(last)
+}
+
+// reject; Records a rejected event, returns true once the client went over
+// budget -ratekick times within rateKickWindow.
+func (l *RateLimiter) reject() bool {
+	now := time.Now()
+	kept := l.rejected[:0]
+	for _, t := range l.rejected {
+		if now.Sub(t) < rateKickWindow {
+			kept = append(kept, t)
+		}
+	}
+	l.rejected = append(kept, now)
+	return *rateKick > 0 && len(l.rejected) >= *rateKick
+}
+
+// rateLimited; sends client a rate-limited event.
+func rateLimited(c *Client, event string, retryAfter time.Duration) {
+	rateLimitedEvent := Event{
+		Event: "rate-limited",
+		Data: RateLimitData{
+			Event:      event,
+			RetryAfter: retryAfter.Milliseconds(),
+		},
+	}
+
+	rateLimitedJson, err := json.Marshal(rateLimitedEvent)
+	if err != nil {
+		logger("ERROR", "Failed to encode rate-limited event:", err)
+		return
+	}
+
+	select {
+	case c.send <- rateLimitedJson:
+	default:
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	got, err := parseRateLimits(" send-msg=1/10, *=0.5/3 ,,typing=2/10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]rateLimit{
+		"send-msg": {rate: 1, burst: 10},
+		"*":        {rate: 0.5, burst: 3},
+		"typing":   {rate: 2, burst: 10},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRateLimits = %v, want %v", got, want)
+	}
+
+	if got, err := parseRateLimits(""); err != nil || len(got) != 0 {
+		t.Errorf("empty spec = %v, %v, want no limits", got, err)
+	}
+
+	for _, spec := range []string{
+		"send-msg",
+		"send-msg=1",
+		"=1/10",
+		"send-msg=x/10",
+		"send-msg=0/10",
+		"send-msg=-1/10",
+		"send-msg=NaN/10",
+		"send-msg=Inf/10",
+		"send-msg=1/0.5",
+		"send-msg=1/NaN",
+		"send-msg=1/10,typing",
+	} {
+		if _, err := parseRateLimits(spec); err == nil {
+			t.Errorf("parseRateLimits(%q) accepted it", spec)
+		}
+	}
+}
+
+// useRateLimits; Sets the budgets for the length of the test.
+func useRateLimits(t *testing.T, spec string) {
+	rateLimitsMu.RLock()
+	old := rateLimits
+	rateLimitsMu.RUnlock()
+	if err := setRateLimits(spec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rateLimitsMu.Lock()
+		rateLimits = old
+		rateLimitsMu.Unlock()
+	})
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	useRateLimits(t, "send-msg=1/2")
+	l := newRateLimiter()
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow("send-msg"); !ok {
+			t.Fatalf("event %d of a burst of 2 was dropped", i+1)
+		}
+	}
+	ok, wait := l.allow("send-msg")
+	if ok {
+		t.Fatal("event over the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("retry after %v, want up to 1s", wait)
+	}
+
+	// no budget and no "*" is unlimited.
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.allow("typing"); !ok {
+			t.Fatal("event without a budget was dropped")
+		}
+	}
+
+	// buckets refill over time.
+	l.buckets["send-msg"].last = time.Now().Add(-2 * time.Second)
+	if ok, _ := l.allow("send-msg"); !ok {
+		t.Error("bucket did not refill")
+	}
+}
+
+func TestRateLimiterDefault(t *testing.T) {
+	useRateLimits(t, "*=1/3,send-msg=1/1")
+	l := newRateLimiter()
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow(fmt.Sprint("made-up-", i)); !ok {
+			t.Fatalf("event %d of a burst of 3 was dropped", i+1)
+		}
+	}
+	// made up names share the bucket of "*".
+	if ok, _ := l.allow("made-up-3"); ok {
+		t.Error("a new event name got a burst of its own")
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets for events without a budget, want 1", len(l.buckets))
+	}
+	// events with a budget keep their own bucket.
+	if ok, _ := l.allow("send-msg"); !ok {
+		t.Error("send-msg drew from the * bucket")
+	}
+}
+
+func TestRateLimiterReject(t *testing.T) {
+	setFlag(t, rateKick, 3)
+	l := newRateLimiter()
+	if l.reject() || l.reject() {
+		t.Fatal("kicked before -ratekick rejections")
+	}
+	if !l.reject() {
+		t.Error("not kicked after -ratekick rejections")
+	}
+
+	// old rejections don't count.
+	l = newRateLimiter()
+	l.rejected = []time.Time{time.Now().Add(-2 * rateKickWindow), time.Now().Add(-2 * rateKickWindow)}
+	if l.reject() {
+		t.Error("rejections outside the window counted")
+	}
+
+	setFlag(t, rateKick, 0)
+	for i := 0; i < 100; i++ {
+		if l.reject() {
+			t.Fatal("kicked with -ratekick 0")
+		}
+	}
+}
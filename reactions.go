@@ -0,0 +1,84 @@
+// File: reactions.go - Emoji reactions on messages
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// emic images are named like the slugs used in messages, *slug*.
+var emicSlugPattern = regexp.MustCompile(`^[a-z0-9-]{1,64}$`)
+
+// most runes in one unicode reaction, enough for flags and ZWJ sequences.
+const maxEmojiRunes = 10
+
+// validReaction; Returns true if emoji is an emic slug or a unicode emoji.
+func validReaction(emoji string) bool {
+	if emicSlugPattern.MatchString(emoji) {
+		stat, err := os.Stat(filepath.Join("html", "static", "emic", emoji+".png"))
+		return err == nil && !stat.IsDir()
+	}
+	return isEmoji(emoji)
+}
+
+// isEmoji; Loosely checks emoji is a single emoji, a short run of symbols
+// glued together with joiners, variation selectors and modifiers.
+func isEmoji(emoji string) bool {
+	count := utf8.RuneCountInString(emoji)
+	if count == 0 || count > maxEmojiRunes || !utf8.ValidString(emoji) {
+		return false
+	}
+
+	symbols := 0
+	for _, r := range emoji {
+		switch {
+		case unicode.Is(unicode.So, r), r == '\u20e3': // symbols, keycap.
+			symbols++
+		case r == '\u200d', // zero width joiner.
+			r >= '\ufe00' && r <= '\ufe0f',          // variation selectors.
+			r >= 0x1f3fb && r <= 0x1f3ff,            // skin tones.
+			r >= 0xe0020 && r <= 0xe007f,            // tags, used by subdivision flags.
+			strings.ContainsRune("0123456789#*", r): // keycap bases.
+		default:
+			return false
+		}
+	}
+	return symbols > 0
+}
+
+// toggleReaction; Adds nick to the reactions of msg for emoji, or removes it
+// if nick already reacted with emoji. The map is copied, as stored messages
+// share it.
+func toggleReaction(msg *MessageData, emoji string, nick string) {
+	reactions := make(map[string][]string, len(msg.Reactions)+1)
+	for k, v := range msg.Reactions {
+		reactions[k] = v
+	}
+
+	nicks := slices.Clone(reactions[emoji])
+	if i := slices.Index(nicks, nick); i >= 0 {
+		nicks = slices.Delete(nicks, i, i+1)
+	} else {
+		nicks = append(nicks, nick)
+	}
+
+	if len(nicks) == 0 {
+		delete(reactions, emoji)
+	} else {
+		reactions[emoji] = nicks
+	}
+
+	msg.Reactions = reactions
+	if len(reactions) == 0 {
+		msg.Reactions = nil
+	}
+}
@@ -0,0 +1,133 @@
+// File: reads.go - Read markers of the rooms
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - The last message id each nick has read, per room. Kept apart from the
+//    hubs, so markers outlive a room that was closed for being empty.
+//  - With -store disk they are saved to <datadir>/reads.json every
+//    readsInterval and survive a restart. The memory store starts its ids
+//    over on restart, so its markers are not saved.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// how often changed read markers are saved.
+const readsInterval = 5 * time.Second
+
+// ReadStore holds the read markers, room -> nick -> message id.
+type ReadStore struct {
+	mu    sync.Mutex
+	path  string // empty keeps the markers in memory only.
+	rooms map[string]map[string]string
+	dirty bool
+}
+
+var markers = newReadStore("")
+
+func newReadStore(path string) *ReadStore {
+	return &ReadStore{path: path, rooms: make(map[string]map[string]string)}
+}
+
+// openReadStore; Loads the markers from path, a missing file has none.
+// An empty path keeps them in memory only.
+func openReadStore(path string) (*ReadStore, error) {
+	s := newReadStore(path)
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.rooms); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+// mark; Moves the read marker of nick in room forward to id.
+// Returns false if nick already read past id.
+func (s *ReadStore) mark(room string, nick string, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reads := s.rooms[room]
+	if reads == nil {
+		reads = make(map[string]string)
+		s.rooms[room] = reads
+	}
+	if last, ok := reads[nick]; ok && parseMessageID(last) >= parseMessageID(id) {
+		return false
+	}
+	reads[nick] = id
+	s.dirty = true
+	return true
+}
+
+// rename; Moves the read marker of old in room to nick.
+func (s *ReadStore) rename(room string, old string, nick string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reads := s.rooms[room]
+	if id, ok := reads[old]; ok {
+		delete(reads, old)
+		reads[nick] = id
+		s.dirty = true
+	}
+}
+
+// room; Returns a copy of the read markers of room.
+func (s *ReadStore) room(room string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reads := make(map[string]string, len(s.rooms[room]))
+	for nick, id := range s.rooms[room] {
+		reads[nick] = id
+	}
+	return reads
+}
+
+// save; Writes the markers to the file if they changed since the last save.
+func (s *ReadStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+	data, err := json.Marshal(s.rooms)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// watchReads; Saves changed read markers every readsInterval.
+func watchReads() {
+	ticker := time.NewTicker(readsInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := markers.save(); err != nil {
+			logger("ERROR", "Failed to save read markers:", err)
+		}
+	}
+}
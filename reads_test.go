@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useMarkers; Gives the test its own read markers.
+func useMarkers(t *testing.T, s *ReadStore) {
+	old := markers
+	markers = s
+	t.Cleanup(func() { markers = old })
+}
+
+func TestReadMarkersOutliveRoom(t *testing.T) {
+	useMarkers(t, newReadStore(""))
+	hub := rooms.get("reads-test")
+	hub.markRead("alice", "msg_5")
+	hub.markRead("bob", "msg_3")
+	if hub.markRead("alice", "msg_4") {
+		t.Error("the marker moved back")
+	}
+
+	hub.mu.Lock()
+	hub.active = time.Now().Add(-roomIdle)
+	hub.mu.Unlock()
+	rooms.closeIdle()
+	if reopened := rooms.get("reads-test"); reopened == hub {
+		t.Fatal("the idle room was not closed")
+	} else {
+		hub = reopened
+	}
+
+	want := map[string]string{"alice": "msg_5", "bob": "msg_3"}
+	if got := hub.readMarkers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("markers after reopening the room = %v, want %v", got, want)
+	}
+}
+
+func TestReadStoreSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reads.json")
+	s, err := openReadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mark("lobby", "alice", "msg_7")
+	s.mark("lobby", "bob", "msg_2")
+	s.rename("lobby", "bob", "robert")
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = openReadStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"alice": "msg_7", "robert": "msg_2"}
+	if got := s.room("lobby"); !reflect.DeepEqual(got, want) {
+		t.Errorf("markers after reopening = %v, want %v", got, want)
+	}
+	if got := s.room("other"); len(got) != 0 {
+		t.Errorf("markers of a room without any = %v", got)
+	}
+}
@@ -0,0 +1,198 @@
+// File: reload.go - Reloading the configuration on SIGHUP
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - On SIGHUP the config file and the environment are read again. Settings
+//    in reloaders are applied right away, other changes are logged as needing
+//    a restart and keep their old value.
+//  - The bans, roles and -motd files and the TLS certificate are read again
+//    too, they may have been edited in place.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+)
+
+var errRestart = errors.New("restart to apply it")
+
+// Reloadable settings that are read while clients are served. A reload sets
+// the flags from its own goroutine, so handlers read these copies instead.
+var (
+	cacheSize        atomic.Int64 // -cache
+	signalingEnabled atomic.Bool  // -signaling
+	commandFile      atomic.Value // -command, a string
+)
+
+// loadReloadable; Copies the flags above into the values handlers read.
+func loadReloadable() {
+	cacheSize.Store(int64(*cache))
+	signalingEnabled.Store(*signaling)
+	commandFile.Store(*command)
+}
+
+// reloaders apply a setting that changed on reload, after its flag is set.
+// An error puts the old value back.
+var reloaders = map[string]func() error{
+	"log": func() error {
+		return setLogLevel(*logLevel)
+	},
+	"cache": func() error {
+		if *cache < 0 {
+			return errors.New("can't be negative")
+		}
+		cacheSize.Store(int64(*cache))
+		return nil
+	},
+	"signaling": func() error {
+		old := signalingEnabled.Swap(*signaling)
+		availableJSON, err := signalingAvailable()
+		if err != nil {
+			signalingEnabled.Store(old)
+			return err
+		}
+		for _, hub := range rooms.all() {
+			hub.emit(availableJSON, nil)
+		}
+		return nil
+	},
+	"ratelimits": func() error {
+		return setRateLimits(*rateLimitSpec)
+	},
+	"command": func() error {
+		commandFile.Store(*command)
+		return nil
+	},
+	// read again by reloadFiles.
+	"bans":     nil,
+	"roles":    nil,
+	"motd":     nil,
+	"certfile": checkTLSFlags,
+	"keyfile":  checkTLSFlags,
+}
+
+// certificate is the TLS certificate served, nil without TLS.
+var certificate atomic.Pointer[tls.Certificate]
+
+// loadCertificate; Reads -certfile and -keyfile, the new certificate is used
+// for the next connections.
+func loadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+	if err != nil {
+		return err
+	}
+	certificate.Store(&cert)
+	return nil
+}
+
+// getCertificate; Serves the current certificate, see tls.Config.
+func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return certificate.Load(), nil
+}
+
+// checkTLSFlags; TLS can't be turned on or off without a restart.
+func checkTLSFlags() error {
+	tlsOn := *certFile != "" && *keyFile != ""
+	if tlsOn != (certificate.Load() != nil) {
+		return errRestart
+	}
+	return nil
+}
+
+// watchReload; Reloads the configuration on every SIGHUP.
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reloadConfig()
+	}
+}
+
+// reloadConfig; Applies the changes to the config file and the environment
+// that are safe while running, and logs the others.
+func reloadConfig() {
+	logger("INFO", "Reloading configuration")
+	settings, err := readSettings()
+	if err != nil {
+		logger("ERROR", "Not reloading:", err)
+		return
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if commandLine[f.Name] || f.Name == "config" {
+			return
+		}
+		value := f.DefValue
+		if s, ok := settings[f.Name]; ok {
+			value = s.value
+		}
+		// compare parsed values, 5m and 5m0s are the same.
+		parsed := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+		if err := parsed.Set(value); err != nil {
+			logger("ERROR", "Not reloading", f.Name+":", err)
+			return
+		}
+		if parsed.String() == f.Value.String() {
+			return
+		}
+
+		apply, ok := reloaders[f.Name]
+		if !ok {
+			logger("INFO", f.Name, "changed,", errRestart)
+			return
+		}
+		old := f.Value.String()
+		f.Value.Set(value)
+		if apply != nil {
+			if err := apply(); err != nil {
+				f.Value.Set(old)
+				if err == errRestart {
+					logger("INFO", f.Name, "changed,", err)
+				} else {
+					logger("ERROR", "Not reloading", f.Name+":", err)
+				}
+				return
+			}
+		}
+		logger("INFO", "Reloaded", f.Name, "=", value)
+	})
+
+	reloadFiles()
+}
+
+// reloadFiles; Reads the files of the settings again, a file that fails keeps
+// what was loaded before.
+func reloadFiles() {
+	if err := bans.reload(dataFile(*banFile, "bans.json")); err != nil {
+		logger("ERROR", "Failed to reload bans:", err)
+	} else {
+		// bans added to the file take effect now.
+		for _, ban := range bans.list() {
+			throwOut(ban.Nick, ban.IP, closeBanned, ban.String())
+		}
+	}
+
+	if err := roles.reload(dataFile(*rolesFile, "roles.json")); err != nil {
+		logger("ERROR", "Failed to reload roles:", err)
+	}
+
+	if text, err := loadMOTD(*motdFile); err != nil {
+		logger("ERROR", "Failed to reload -motd:", err)
+	} else {
+		motd.Store(text)
+	}
+
+	if certificate.Load() != nil {
+		if err := loadCertificate(); err != nil {
+			logger("ERROR", "Failed to reload the TLS certificate:", err)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// File: roles.go - Owner, moderator and user roles
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Roles are kept in a JSON file of nick -> role, see -roles. Owners, or
+//    anyone with -admintoken, grant them with the set-role event.
+//  - A role only counts for a registered nick, a guest can't claim one by
+//    picking the nick while its owner is away.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleOwner     = "owner"
+)
+
+// roleRanks orders the roles, a higher rank may moderate the lower ones.
+var roleRanks = map[string]int{
+	roleUser:      0,
+	roleModerator: 1,
+	roleOwner:     2,
+}
+
+type roleEntry struct {
+	nick string
+	role string
+}
+
+// RoleStore holds the granted roles, keyed by nick skeleton. Nicks without an
+// entry are users.
+type RoleStore struct {
+	mu    sync.Mutex
+	path  string
+	roles map[string]roleEntry
+}
+
+var roles *RoleStore
+
+// openRoleStore; Loads the roles file at path, a missing file grants nothing.
+func openRoleStore(path string) (*RoleStore, error) {
+	entries, err := readRoles(path)
+	if err != nil {
+		return nil, err
+	}
+	return &RoleStore{path: path, roles: entries}, nil
+}
+
+// readRoles; Reads the roles file at path, keyed by nick skeleton.
+func readRoles(path string) (map[string]roleEntry, error) {
+	entries := make(map[string]roleEntry)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file map[string]string
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for nick, role := range file {
+		if _, ok := roleRanks[role]; !ok {
+			return nil, fmt.Errorf("%s: unknown role %q of %s", path, role, nick)
+		}
+		if role != roleUser {
+			entries[nickSkeleton(nick)] = roleEntry{nick: nick, role: role}
+		}
+	}
+	return entries, nil
+}
+
+// reload; Replaces the roles with the ones in the file at path, for edits
+// made while running. On error the roles in memory are kept.
+func (s *RoleStore) reload(path string) error {
+	entries, err := readRoles(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	s.roles = entries
+	return nil
+}
+
+// role; Returns the role of nick. Unregistered nicks are always users.
+func (s *RoleStore) role(nick string) string {
+	if !accounts.registered(nick) {
+		return roleUser
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.roles[nickSkeleton(nick)]; ok {
+		return entry.role
+	}
+	return roleUser
+}
+
+// setRole; Grants nick role and saves the file, roleUser takes a role away.
+func (s *RoleStore) setRole(nick string, role string) error {
+	if _, ok := roleRanks[role]; !ok {
+		return fmt.Errorf("Unknown role %q, use owner, moderator or user.", role)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := nickSkeleton(nick)
+	old, had := s.roles[key]
+	if !had && role == roleUser {
+		return nil
+	}
+	if role == roleUser {
+		delete(s.roles, key)
+	} else {
+		s.roles[key] = roleEntry{nick: nick, role: role}
+	}
+
+	if err := s.write(); err != nil {
+		logger("ERROR", "Failed to save roles:", err)
+		if had {
+			s.roles[key] = old
+		} else {
+			delete(s.roles, key)
+		}
+		return errors.New("Failed to save, try again later.")
+	}
+	return nil
+}
+
+// write; Replaces the roles file with the roles in memory. Caller holds s.mu.
+func (s *RoleStore) write() error {
+	file := make(map[string]string, len(s.roles))
+	for _, entry := range s.roles {
+		file[entry.nick] = entry.role
+	}
+	data, err := json.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// rankOf; Returns the rank of the role of nick.
+func rankOf(nick string) int {
+	return roleRanks[roles.role(nick)]
+}
+
+// isModerator; Returns true if c is logged in as a moderator or owner.
+func isModerator(c *Client) bool {
+	return c.nick() != "" && rankOf(c.nick()) >= roleRanks[roleModerator]
+}
@@ -0,0 +1,251 @@
+// File: rooms.go - Room registry, creates hubs on demand
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// every client starts out in this room.
+const defaultRoom = "lobby"
+
+// rooms nobody was in for this long are closed, the lobby stays.
+const roomIdle = time.Minute
+
+var roomNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// RoomRegistry holds a Hub for each named room.
+type RoomRegistry struct {
+	mu   sync.Mutex
+	hubs map[string]*Hub
+}
+
+var rooms = &RoomRegistry{hubs: make(map[string]*Hub)}
+
+// get; Returns the hub for a room, creating and starting it if needed.
+func (r *RoomRegistry) get(name string) *Hub {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if hub, ok := r.hubs[name]; ok {
+		// not closed before the caller enters it.
+		hub.touch()
+		return hub
+	}
+	hub := newHub(name)
+	r.hubs[name] = hub
+	go hub.run()
+	logger("INFO", "Created room:", name)
+	return hub
+}
+
+// closeIdle; Closes the rooms empty for roomIdle, their goroutine stops.
+func (r *RoomRegistry) closeIdle() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, hub := range r.hubs {
+		if name != defaultRoom && hub.idleFor() >= roomIdle {
+			delete(r.hubs, name)
+			close(hub.quit)
+			logger("INFO", "Closed empty room:", name)
+		}
+	}
+}
+
+// watchRooms; Closes empty rooms, so rooms joined once don't pile up, and
+// prunes the spam windows and mutes of nicks that left.
+func watchRooms() {
+	ticker := time.NewTicker(roomIdle / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rooms.closeIdle()
+		pruneSpam()
+	}
+}
+
+// all; Returns every hub, sorted by room name.
+func (r *RoomRegistry) all() []*Hub {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hubs := make([]*Hub, 0, len(r.hubs))
+	for _, hub := range r.hubs {
+		hubs = append(hubs, hub)
+	}
+	sort.Slice(hubs, func(i, j int) bool { return hubs[i].name < hubs[j].name })
+	return hubs
+}
+
+// clientsByNick; Returns the clients logged in as nick, or a nick that looks
+// like it, in any room.
+func (r *RoomRegistry) clientsByNick(nick string) []*Client {
+	var found []*Client
+	for _, hub := range r.all() {
+		hub.mu.RLock()
+		for _, client := range hub.clients {
+			if client.nick() != "" && sameNick(client.nick(), nick) {
+				found = append(found, client)
+			}
+		}
+		hub.mu.RUnlock()
+	}
+	return found
+}
+
+// nickOf; Returns the nick of the client with id in any room, false if it is
+// not connected or not logged in.
+func (r *RoomRegistry) nickOf(id string) (string, bool) {
+	for _, hub := range r.all() {
+		hub.mu.RLock()
+		client, ok := hub.clients[id]
+		nick := ""
+		if ok {
+			nick = client.nick()
+		}
+		hub.mu.RUnlock()
+		if nick != "" {
+			return nick, true
+		}
+	}
+	return "", false
+}
+
+// sendToNick; Sends message to every client logged in as nick, in any room.
+// Returns how many got it.
+func (r *RoomRegistry) sendToNick(nick string, message []byte) int {
+	sent := 0
+	for _, hub := range r.all() {
+		// held while sending, so run can't close a send channel meanwhile.
+		hub.mu.RLock()
+		for _, client := range hub.clients {
+			if client.nick() != nick {
+				continue
+			}
+			select {
+			case client.send <- message:
+				sent++
+			default:
+				logger("ERROR", "Send buffer full, dropping message for:", client.nick())
+			}
+		}
+		hub.mu.RUnlock()
+	}
+	return sent
+}
+
+// normalizeRoomName; Lower-cases name and checks it is usable as a room name.
+func normalizeRoomName(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return name, roomNamePattern.MatchString(name)
+}
+
+// enterRoom; Adds a logged in client to hub, sends it the room state and
+// tells the others in the room.
+func enterRoom(c *Client, hub *Hub) {
+	c.setHub(hub)
+	hub.register <- c
+	hub.addUser(c.nick())
+	logger("DEBUG", "Updated users list for", hub.name+":", hub.userList())
+
+	// Tell this user who is already in.
+	startEvent := Event{
+		Event: "start",
+		Data: EventData{
+			Nick:   c.nick(), // as the server normalized it.
+			Users:  hub.roster(),
+			Room:   hub.name,
+			Reads:  hub.readMarkers(),
+			Token:  resumeToken(c),
+			Upload: uploadToken(c),
+			Role:   roles.role(c.nick()),
+			Topic:  topics.topic(hub.name),
+			Typing: hub.typingList(),
+			MOTD:   messageOfTheDay(),
+		},
+	}
+
+	startEventJSON, err := json.Marshal(startEvent)
+	if err != nil {
+		logger("ERROR", "Failed to encode start event:", err)
+		return
+	}
+
+	logger("DEBUG", "Emitting start event:", string(startEventJSON))
+	c.send <- startEventJSON
+
+	// tell everyone in the room "user" entered.
+	userEnteredEvent := Event{
+		Event: "ue",
+		Data: EventData{
+			Nick: c.nick(),
+		},
+	}
+
+	userEnteredJSON, err := json.Marshal(userEnteredEvent)
+	if err != nil {
+		logger("ERROR", "Failed to encode user entered event:", err)
+		return
+	}
+	hub.emit(userEnteredJSON, c)
+
+	// send the newest messages of the room to "user".
+	recent, err := history.Recent(hub.name, int(cacheSize.Load()))
+	if err != nil {
+		logger("ERROR", "Failed to load history of", hub.name+":", err)
+		recent = []MessageData{}
+	}
+	cacheEvent := MessageCacheResponse{
+		Event: "previous-msg",
+		Msgs:  recent,
+	}
+
+	cacheJSON, err := json.Marshal(cacheEvent)
+	if err != nil {
+		logger("ERROR", "Failed to encode message cache:", err)
+		return
+	}
+	logger("DEBUG", "Emitting previous-msgs event for:", c.nick(), "with", len(cacheEvent.Msgs), "messages")
+	c.send <- cacheJSON
+}
+
+// announceLeave; Tells everyone in hub but skip that nick left.
+func announceLeave(hub *Hub, nick string, skip *Client) {
+	userLeftEvent := Event{
+		Event: "ul",
+		Data: EventData{
+			Nick: nick,
+		},
+	}
+
+	userLeftJson, err := json.Marshal(userLeftEvent)
+	if err != nil {
+		logger("ERROR", "Failed to encode user left event:", err)
+		return
+	}
+	hub.emit(userLeftJson, skip)
+}
+
+// leaveRoom; Removes a logged in client from its room and tells the others.
+// When disconnecting is false the client's connection is kept open, so it can
+// enter another room.
+func leaveRoom(c *Client, disconnecting bool) {
+	hub := c.hub()
+	hub.setTyping(c.nick(), false)
+	hub.removeUser(c.nick())
+	announceLeave(hub, c.nick(), c)
+
+	if disconnecting {
+		endSession(c)
+		hub.remove(c)
+	} else {
+		hub.part <- c
+	}
+	logger("DEBUG", "Removed", c.nick(), "from", hub.name)
+}
@@ -0,0 +1,302 @@
+// File: sessions.go - Resume tokens and nick holds for seamless reconnects
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Every logged in client gets a signed resume token in its start event.
+//  - When the connection drops, the nick stays in its room for -resumegrace
+//    without anyone being told, nobody else can take it meanwhile.
+//  - A new connection sending resume with the token takes the session over and
+//    gets only the messages it missed, no ul/ue is broadcast.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most messages replayed on resume, older ones are left to fetch-history.
+const maxResumeReplay = 500
+
+// heldSession is the nick and room of a dropped connection, kept until it
+// resumes or the grace period is over.
+type heldSession struct {
+	nick   string
+	hub    *Hub
+	timer  *time.Timer
+	state  string // chosen presence, it comes back on resume.
+	status string
+}
+
+var (
+	sessionKey = newSessionKey()
+
+	sessionsMu sync.Mutex
+	live       = make(map[string]*Client)      // session id -> connected client.
+	held       = make(map[string]*heldSession) // session id -> dropped client.
+)
+
+// newSessionKey; Returns the key resume tokens are signed with. Tokens don't
+// survive a restart, neither do holds.
+func newSessionKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// signSession; Returns the resume token of a session id.
+func signSession(id string) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseResumeToken; Checks the signature of token and returns its session id.
+func parseResumeToken(token string) (string, error) {
+	id, _, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signSession(id)), []byte(token)) {
+		return "", errors.New("invalid resume token")
+	}
+	return id, nil
+}
+
+// uploadToken; Returns the token c sends with uploads, it is good for as
+// long as c is connected and logged in.
+func uploadToken(c *Client) string {
+	return signSession("upload-" + c.id)
+}
+
+// uploader; Returns the nick of the logged in client an upload token
+// belongs to.
+func uploader(token string) (string, error) {
+	id, err := parseResumeToken(token)
+	if err != nil || !strings.HasPrefix(id, "upload-") {
+		return "", errors.New("invalid upload token")
+	}
+	nick, ok := rooms.nickOf(strings.TrimPrefix(id, "upload-"))
+	if !ok {
+		return "", errors.New("not logged in")
+	}
+	return nick, nil
+}
+
+// resumeToken; Returns the token of c, starting a session if it has none.
+// Empty if resuming is disabled.
+func resumeToken(c *Client) string {
+	if *resumeGrace <= 0 {
+		return ""
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if c.session == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			logger("ERROR", "Failed to start session:", err)
+			return ""
+		}
+		c.session = hex.EncodeToString(id)
+		live[c.session] = c
+	}
+	return signSession(c.session)
+}
+
+// holdSession; Keeps the nick of a dropped client in its room for
+// -resumegrace. Returns false if the client has no session to hold, it must
+// leave the room now.
+func holdSession(c *Client) bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if c.session == "" {
+		return false
+	}
+	if live[c.session] != c {
+		// another connection resumed it already, nothing to hold.
+		return true
+	}
+	delete(live, c.session)
+
+	id := c.session
+	state, status := c.chosenPresence()
+	held[id] = &heldSession{
+		nick:   c.nick(),
+		hub:    c.hub(),
+		timer:  time.AfterFunc(*resumeGrace, func() { expireSession(id) }),
+		state:  state,
+		status: status,
+	}
+	logger("DEBUG", "Holding", c.nick(), "in", c.hub().name, "for", *resumeGrace)
+	return true
+}
+
+// expireSession; Ends a hold that was not resumed in time, the nick leaves.
+func expireSession(id string) {
+	sessionsMu.Lock()
+	s, ok := held[id]
+	delete(held, id)
+	sessionsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	logger("DEBUG", "Session of", s.nick, "expired")
+	s.hub.removeUser(s.nick)
+	announceLeave(s.hub, s.nick, nil)
+}
+
+// dropHeld; Ends the holds of nick now, without waiting for them to expire.
+// Returns the rooms it left.
+func dropHeld(nick string) []*Hub {
+	sessionsMu.Lock()
+	var ids []string
+	for id, s := range held {
+		if sameNick(s.nick, nick) {
+			s.timer.Stop()
+			ids = append(ids, id)
+		}
+	}
+	sessionsMu.Unlock()
+
+	var left []*Hub
+	for _, id := range ids {
+		sessionsMu.Lock()
+		s, ok := held[id]
+		sessionsMu.Unlock()
+		if ok {
+			left = append(left, s.hub)
+			expireSession(id)
+		}
+	}
+	return left
+}
+
+// heldPresence; Returns the roster entry of a nick held for a dropped
+// connection, it is idle until it resumes.
+func heldPresence(nick string) (RosterEntry, bool) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	for _, s := range held {
+		if s.nick == nick {
+			return RosterEntry{Nick: nick, State: presenceIdle, Status: s.status}, true
+		}
+	}
+	return RosterEntry{}, false
+}
+
+// endSession; Drops the session of c, its token can't be used anymore.
+func endSession(c *Client) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if c.session != "" && live[c.session] == c {
+		delete(live, c.session)
+	}
+	c.session = ""
+}
+
+// takeSession; Moves the session of token to c. Returns the nick and room
+// it had. A connection still holding the session, one that dropped without
+// the server noticing yet, is closed.
+func takeSession(c *Client, token string) (string, *Hub, error) {
+	id, err := parseResumeToken(token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	if s, ok := held[id]; ok {
+		s.timer.Stop()
+		delete(held, id)
+		c.session = id
+		live[id] = c
+		c.setPresence(s.state, s.status)
+		return s.nick, s.hub, nil
+	}
+
+	old, ok := live[id]
+	if !ok {
+		return "", nil, errors.New("session expired")
+	}
+	c.session = id
+	live[id] = c
+	c.setPresence(old.chosenPresence())
+	// its disconnect finds the session taken and leaves the nick alone.
+	old.conn.Close()
+	return old.nick(), old.hub(), nil
+}
+
+// resumeRoom; Puts a resumed client back into hub, without telling the room,
+// and sends it the messages after lastID.
+func resumeRoom(c *Client, hub *Hub, lastID string) {
+	if c.hub() != hub {
+		c.hub().part <- c
+		c.setHub(hub)
+	}
+	hub.register <- c
+	// the old connection may have left the list if it was moving rooms.
+	if !hub.hasUser(c.nick()) {
+		hub.addUser(c.nick())
+	}
+
+	startEvent := Event{
+		Event: "start",
+		Data: EventData{
+			Nick:    c.nick(),
+			Users:   hub.roster(),
+			Room:    hub.name,
+			Reads:   hub.readMarkers(),
+			Token:   resumeToken(c),
+			Upload:  uploadToken(c),
+			Resumed: true,
+			Role:    roles.role(c.nick()),
+			Topic:   topics.topic(hub.name),
+			Typing:  hub.typingList(),
+			MOTD:    messageOfTheDay(),
+		},
+	}
+	startEventJSON, err := json.Marshal(startEvent)
+	if err != nil {
+		logger("ERROR", "Failed to encode start event:", err)
+		return
+	}
+	c.send <- startEventJSON
+
+	recent, err := history.Recent(hub.name, maxResumeReplay)
+	if err != nil {
+		logger("ERROR", "Failed to load history of", hub.name+":", err)
+		recent = nil
+	}
+	missed := []MessageData{}
+	last := parseMessageID(lastID)
+	for _, msg := range recent {
+		if parseMessageID(msg.ID) > last {
+			missed = append(missed, msg)
+		}
+	}
+	// without a last id it had seen nothing, send what a new user gets.
+	if limit := int(cacheSize.Load()); last < 0 && len(missed) > limit {
+		missed = missed[len(missed)-limit:]
+	}
+
+	cacheJSON, err := json.Marshal(MessageCacheResponse{
+		Event: "previous-msg",
+		Msgs:  missed,
+	})
+	if err != nil {
+		logger("ERROR", "Failed to encode message cache:", err)
+		return
+	}
+	logger("DEBUG", "Resumed", c.nick(), "in", hub.name, "with", len(missed), "missed messages")
+	c.send <- cacheJSON
+}
@@ -0,0 +1,180 @@
+// File: spam.go - Spam and flood detection, temporary mutes
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Looks at the last spamWindow of messages of each nick for repeated text,
+//    repeated attachments and mass mentions.
+//  - A nick caught spamming is muted for -mutetime, send-msg and send-dm are
+//    rejected until then.
+//  - Windows of nicks that went quiet and expired mutes are pruned by the
+//    room watcher.
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// How far back messages of a nick are looked at.
+	spamWindow = 30 * time.Second
+
+	// Same text or attachment this many times in the window is spam.
+	spamRepeats = 3
+
+	// Mentions of other users in the window, or in a single message.
+	spamMentions       = 10
+	spamMentionsPerMsg = 5
+)
+
+type spamEntry struct {
+	at         time.Time
+	text       string
+	attachment string
+	mentions   int
+}
+
+type mute struct {
+	until  time.Time
+	reason string
+}
+
+var (
+	spamMu     sync.Mutex
+	spamRecent = make(map[string][]spamEntry) // nick -> messages in the window.
+	mutes      = make(map[string]mute)        // nick skeleton -> active mute.
+)
+
+// muteNick; Mutes nick for d.
+func muteNick(nick string, d time.Duration, reason string) {
+	spamMu.Lock()
+	defer spamMu.Unlock()
+	mutes[nickSkeleton(nick)] = mute{until: time.Now().Add(d), reason: reason}
+	delete(spamRecent, nick)
+}
+
+// unmuteNick; Lifts the mute of nick, returns false if there was none.
+func unmuteNick(nick string) bool {
+	spamMu.Lock()
+	defer spamMu.Unlock()
+	key := nickSkeleton(nick)
+	m, ok := mutes[key]
+	delete(mutes, key)
+	return ok && time.Now().Before(m.until)
+}
+
+// renameSpam; Moves the recent messages of old to nick, a new nick does not
+// start with a clean window.
+func renameSpam(old string, nick string) {
+	spamMu.Lock()
+	defer spamMu.Unlock()
+	if recent, ok := spamRecent[old]; ok {
+		delete(spamRecent, old)
+		spamRecent[nick] = recent
+	}
+}
+
+// mutedFor; Returns how long nick stays muted and why, 0 if it is not.
+func mutedFor(nick string) (time.Duration, string) {
+	spamMu.Lock()
+	defer spamMu.Unlock()
+	key := nickSkeleton(nick)
+	m, ok := mutes[key]
+	if !ok {
+		return 0, ""
+	}
+	left := time.Until(m.until)
+	if left <= 0 {
+		delete(mutes, key)
+		return 0, ""
+	}
+	return left, m.reason
+}
+
+// pruneSpam; Forgets the windows of nicks that sent nothing for spamWindow
+// and the mutes that ran out.
+func pruneSpam() {
+	spamMu.Lock()
+	defer spamMu.Unlock()
+	now := time.Now()
+	for nick, recent := range spamRecent {
+		if len(recent) == 0 || now.Sub(recent[len(recent)-1].at) >= spamWindow {
+			delete(spamRecent, nick)
+		}
+	}
+	for key, m := range mutes {
+		if !now.Before(m.until) {
+			delete(mutes, key)
+		}
+	}
+}
+
+// checkSpam; Records a message of c and returns why it is spam, or "".
+func checkSpam(c *Client, m Message) string {
+	entry := spamEntry{
+		at:         time.Now(),
+		text:       strings.ToLower(strings.Join(strings.Fields(m.Text), " ")),
+		attachment: m.Url,
+		mentions:   countMentions(m.Text, c.hub().userList(), c.nick()),
+	}
+	if entry.mentions >= spamMentionsPerMsg {
+		return "mass mentions"
+	}
+
+	spamMu.Lock()
+	defer spamMu.Unlock()
+	var recent []spamEntry
+	for _, e := range spamRecent[c.nick()] {
+		if entry.at.Sub(e.at) < spamWindow {
+			recent = append(recent, e)
+		}
+	}
+	recent = append(recent, entry)
+	spamRecent[c.nick()] = recent
+
+	sameText, sameAttachment, mentions := 0, 0, 0
+	for _, e := range recent {
+		if entry.text != "" && e.text == entry.text {
+			sameText++
+		}
+		if entry.attachment != "" && e.attachment == entry.attachment {
+			sameAttachment++
+		}
+		mentions += e.mentions
+	}
+
+	switch {
+	case sameText >= spamRepeats:
+		return "repeated message"
+	case sameAttachment >= spamRepeats:
+		return "repeated attachment"
+	case mentions >= spamMentions:
+		return "mass mentions"
+	}
+	return ""
+}
+
+// countMentions; Counts the distinct users of nicks named in text, except self.
+func countMentions(text string, nicks []string, self string) int {
+	if text == "" {
+		return 0
+	}
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return unicode.IsSpace(r) || r == ',' || r == ':' || r == ';'
+	}) {
+		words[strings.TrimPrefix(word, "@")] = true
+	}
+
+	count := 0
+	for _, nick := range nicks {
+		if nick != self && words[strings.ToLower(nick)] {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneSpam(t *testing.T) {
+	spamMu.Lock()
+	now := time.Now()
+	spamRecent["quiet"] = []spamEntry{{at: now.Add(-2 * spamWindow)}}
+	spamRecent["talking"] = []spamEntry{{at: now.Add(-2 * spamWindow)}, {at: now}}
+	mutes["expired"] = mute{until: now.Add(-time.Second)}
+	mutes["muted"] = mute{until: now.Add(time.Minute)}
+	spamMu.Unlock()
+	t.Cleanup(func() {
+		spamMu.Lock()
+		for _, nick := range []string{"quiet", "talking"} {
+			delete(spamRecent, nick)
+		}
+		for _, key := range []string{"expired", "muted"} {
+			delete(mutes, key)
+		}
+		spamMu.Unlock()
+	})
+
+	pruneSpam()
+
+	spamMu.Lock()
+	defer spamMu.Unlock()
+	if _, ok := spamRecent["quiet"]; ok {
+		t.Error("the window of a quiet nick was kept")
+	}
+	if _, ok := spamRecent["talking"]; !ok {
+		t.Error("the window of a nick still talking was dropped")
+	}
+	if _, ok := mutes["expired"]; ok {
+		t.Error("an expired mute was kept")
+	}
+	if _, ok := mutes["muted"]; !ok {
+		t.Error("an active mute was dropped")
+	}
+}
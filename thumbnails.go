@@ -0,0 +1,229 @@
+// File: thumbnails.go - Downscaled previews of image attachments
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Inline data: images are moved into the blob store, history only keeps urls.
+//  - Images larger than thumbSize get a thumbnail, clients load the full image
+//    on demand.
+//  - The thumbnail and dimensions are remembered in the source blob's metadata.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // decoder only.
+	"image/jpeg"
+	"image/png"
+	"mime"
+	"os"
+	"strings"
+)
+
+const (
+	// Longest side of a thumbnail in pixels.
+	thumbSize = 320
+
+	// Larger images are not decoded at all, decoding takes 4 to 8 bytes per
+	// pixel.
+	maxImagePixels = 16_000_000
+)
+
+// thumbSlots limits how many images are decoded at once, senders wait for a
+// free slot.
+var thumbSlots = make(chan struct{}, 2)
+
+// decodeDataURL; Splits a data: url into its media type and decoded content.
+func decodeDataURL(url string) (string, []byte, error) {
+	rest, ok := strings.CutPrefix(url, "data:")
+	if !ok {
+		return "", nil, errors.New("not a data url")
+	}
+	header, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", nil, errors.New("malformed data url")
+	}
+
+	mediaType := header
+	base64Encoded := false
+	if before, found := strings.CutSuffix(header, ";base64"); found {
+		mediaType = before
+		base64Encoded = true
+	}
+	if mediaType == "" {
+		mediaType = "text/plain;charset=US-ASCII"
+	}
+
+	if !base64Encoded {
+		return mediaType, []byte(payload), nil
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed data url: %v", err)
+	}
+	return mediaType, data, nil
+}
+
+// attachImage; Moves an inline image into the blob store and fills in the
+// thumbnail and dimensions of m. Anything but stored or inline images is left
+// alone.
+func attachImage(m *Message) error {
+	// these are ours to set.
+	m.ThumbUrl, m.Width, m.Height = "", 0, 0
+
+	mediaType, _, _ := mime.ParseMediaType(m.Type)
+	if !strings.HasPrefix(mediaType, "image/") {
+		return nil
+	}
+
+	if strings.HasPrefix(m.Url, "data:") {
+		_, data, err := decodeDataURL(m.Url)
+		if err != nil {
+			return err
+		}
+		limit := *maxUploadSize * 1024 * 1024
+		hash, _, err := storeBlob(bytes.NewReader(data), BlobMeta{Type: m.Type, Name: m.Name}, limit)
+		if err != nil {
+			return err
+		}
+		m.Url = blobURLPrefix + hash
+	}
+
+	hash := blobHash(m.Url)
+	if hash == "" {
+		return nil
+	}
+	meta, err := readBlobMeta(hash)
+	if err != nil {
+		return err
+	}
+
+	if meta.Width == 0 {
+		meta, err = makeThumbnail(hash, meta)
+		if err != nil {
+			// not worth failing the message over, it is shown full size.
+			logger("ERROR", "Failed to make thumbnail for", hash+":", err)
+			return nil
+		}
+	}
+
+	m.Width, m.Height = meta.Width, meta.Height
+	if meta.Thumb != "" {
+		m.ThumbUrl = blobURLPrefix + meta.Thumb
+	}
+	return nil
+}
+
+// makeThumbnail; Decodes the blob, stores a thumbnail if it is large and
+// saves the result in its metadata.
+func makeThumbnail(hash string, meta BlobMeta) (BlobMeta, error) {
+	f, err := os.Open(blobPath(hash))
+	if err != nil {
+		return meta, err
+	}
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return meta, err
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return meta, fmt.Errorf("image too large, %dx%d", config.Width, config.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return meta, err
+	}
+
+	thumbSlots <- struct{}{}
+	defer func() { <-thumbSlots }()
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return meta, err
+	}
+	bounds := src.Bounds()
+	meta.Width, meta.Height = bounds.Dx(), bounds.Dy()
+
+	if meta.Width > thumbSize || meta.Height > thumbSize {
+		width, height := thumbSize, thumbSize
+		if meta.Width > meta.Height {
+			height = max(1, meta.Height*thumbSize/meta.Width)
+		} else {
+			width = max(1, meta.Width*thumbSize/meta.Height)
+		}
+		thumb := downscale(src, width, height)
+
+		var buf bytes.Buffer
+		thumbMeta := BlobMeta{Name: "thumb-" + meta.Name}
+		if opaque(src) {
+			thumbMeta.Type = "image/jpeg"
+			err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 80})
+		} else {
+			thumbMeta.Type = "image/png"
+			err = png.Encode(&buf, thumb)
+		}
+		if err != nil {
+			return meta, err
+		}
+
+		meta.Thumb, _, err = storeBlob(&buf, thumbMeta, int64(buf.Len()))
+		if err != nil {
+			return meta, err
+		}
+	}
+
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return meta, err
+	}
+	logger("DEBUG", "Thumbnail for", hash, "is", meta.Thumb)
+	return meta, writeFileAtomic(blobPath(hash)+".json", metaJSON)
+}
+
+// opaque; Returns true if img has no transparent pixels, so it can be a jpeg.
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// downscale; Resizes src to width x height, averaging the source pixels that
+// fall into each target pixel. Only the source rows of one target row are
+// converted to RGBA at a time.
+func downscale(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	band := image.NewRGBA(image.Rect(0, 0, srcW, srcH/height+2))
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcH/height, max((y+1)*srcH/height, y*srcH/height+1)
+		draw.Draw(band, image.Rect(0, 0, srcW, y1-y0), src, image.Pt(bounds.Min.X, bounds.Min.Y+y0), draw.Src)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcW/width, max((x+1)*srcW/width, x*srcW/width+1)
+
+			var r, g, b, a, n int
+			for sy := 0; sy < y1-y0; sy++ {
+				row := band.Pix[sy*band.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestDownscale(t *testing.T) {
+	red := color.NRGBA{255, 0, 0, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			if x < 200 {
+				src.Set(x, y, red)
+			} else {
+				src.Set(x, y, blue)
+			}
+		}
+	}
+
+	// a sub-image has bounds that don't start at 0,0.
+	for _, img := range []image.Image{src, src.SubImage(image.Rect(100, 50, 300, 250))} {
+		dst := downscale(img, 20, 20)
+		if got := dst.Bounds(); got != image.Rect(0, 0, 20, 20) {
+			t.Fatalf("bounds %v, want 20x20", got)
+		}
+		for y := 0; y < 20; y++ {
+			if got := dst.RGBAAt(0, y); got != (color.RGBA{255, 0, 0, 255}) {
+				t.Errorf("%v: pixel 0,%d = %v, want red", img.Bounds(), y, got)
+			}
+			if got := dst.RGBAAt(19, y); got != (color.RGBA{0, 0, 255, 255}) {
+				t.Errorf("%v: pixel 19,%d = %v, want blue", img.Bounds(), y, got)
+			}
+		}
+	}
+}
+
+func TestDownscaleAverages(t *testing.T) {
+	src := image.NewGray(image.Rect(0, 0, 2, 2))
+	src.Pix = []uint8{0, 100, 200, 100}
+	dst := downscale(src, 1, 1)
+	if got := dst.RGBAAt(0, 0); got != (color.RGBA{100, 100, 100, 255}) {
+		t.Errorf("average of 0, 100, 200, 100 = %v, want 100", got)
+	}
+}
+
+func TestDecodeDataURL(t *testing.T) {
+	tests := []struct {
+		url, mediaType, content string
+	}{
+		{"data:text/plain,hello", "text/plain", "hello"},
+		{"data:image/png;base64,aGk=", "image/png", "hi"},
+		{"data:,x", "text/plain;charset=US-ASCII", "x"},
+	}
+	for _, test := range tests {
+		mediaType, content, err := decodeDataURL(test.url)
+		if err != nil || mediaType != test.mediaType || string(content) != test.content {
+			t.Errorf("decodeDataURL(%q) = %q, %q, %v", test.url, mediaType, content, err)
+		}
+	}
+	for _, url := range []string{"http://x/y.png", "data:image/png", "data:image/png;base64,!!"} {
+		if _, _, err := decodeDataURL(url); err == nil {
+			t.Errorf("decodeDataURL(%q) accepted it", url)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// File: topics.go - Room topics and the message of the day
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - Each room may have a topic, set with the set-topic event or /topic and
+//    kept in <datadir>/topics.json, so it survives a restart.
+//  - The message of the day is read from -motd. Both are sent in start, topic
+//    changes go to the room as topic-changed.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const maxTopicLength = 300
+
+// Topic is the topic of a room as stored on disk and sent to clients.
+type Topic struct {
+	Room string    `json:"room"`
+	Text string    `json:"text"`
+	By   string    `json:"by,omitempty"`
+	Set  time.Time `json:"set"`
+}
+
+// TopicStore holds the topics of the rooms, keyed by room name.
+type TopicStore struct {
+	mu     sync.Mutex
+	path   string
+	topics map[string]Topic
+}
+
+var topics *TopicStore
+
+// motd is the message of the day read from -motd, a string. It changes when
+// the config is reloaded.
+var motd atomic.Value
+
+// messageOfTheDay; Returns the message of the day, empty if there is none.
+func messageOfTheDay() string {
+	text, _ := motd.Load().(string)
+	return text
+}
+
+// openTopicStore; Loads <dir>/topics.json, a missing file has no topics.
+func openTopicStore(dir string) (*TopicStore, error) {
+	s := &TopicStore{
+		path:   filepath.Join(dir, "topics.json"),
+		topics: make(map[string]Topic),
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Topic
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", s.path, err)
+	}
+	for _, topic := range list {
+		s.topics[topic.Room] = topic
+	}
+	return s, nil
+}
+
+// topic; Returns the topic of room, nil if it has none.
+func (s *TopicStore) topic(room string) *Topic {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	topic, ok := s.topics[room]
+	if !ok {
+		return nil
+	}
+	return &topic
+}
+
+// setTopic; Sets the topic of room and saves the file, an empty text clears it.
+func (s *TopicStore) setTopic(room string, text string, by string) (Topic, error) {
+	text = strings.TrimSpace(text)
+	if utf8.RuneCountInString(text) > maxTopicLength {
+		return Topic{}, fmt.Errorf("Topic can't be longer than %d characters.", maxTopicLength)
+	}
+	topic := Topic{Room: room, Text: text, By: by, Set: time.Now().UTC()}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, had := s.topics[room]
+	if text == "" {
+		delete(s.topics, room)
+	} else {
+		s.topics[room] = topic
+	}
+
+	if err := s.write(); err != nil {
+		logger("ERROR", "Failed to save topics:", err)
+		if had {
+			s.topics[room] = old
+		} else {
+			delete(s.topics, room)
+		}
+		return Topic{}, errors.New("Failed to save, try again later.")
+	}
+	return topic, nil
+}
+
+// write; Replaces the topics file with the topics in memory. Caller holds s.mu.
+func (s *TopicStore) write() error {
+	list := make([]Topic, 0, len(s.topics))
+	for _, topic := range s.topics {
+		list = append(list, topic)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Room < list[j].Room })
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// loadMOTD; Reads the message of the day from path, an empty path has none.
+func loadMOTD(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
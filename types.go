@@ -14,12 +14,30 @@ type Message struct {
 	Type string `json:"type,omitempty"`
 	Name string `json:"name,omitempty"`
 	Url  string `json:"url,omitempty"`
+
+	// set by the server for images.
+	ThumbUrl string `json:"thumbUrl,omitempty"`
+	Width    int    `json:"width,omitempty"`
+	Height   int    `json:"height,omitempty"`
 }
 
 type MessageData struct {
-	From string  `json:"f"`
-	ID   string  `json:"id"`
-	M    Message `json:"m"`
+	From    string  `json:"f"`
+	To      string  `json:"to,omitempty"` // only set on direct messages.
+	ID      string  `json:"id"`
+	ReplyTo string  `json:"replyTo,omitempty"` // id of the thread's first message.
+	M       Message `json:"m"`
+	Edited  bool    `json:"edited,omitempty"`
+	Deleted bool    `json:"deleted,omitempty"` // tombstone, M is cleared.
+	Action  bool    `json:"action,omitempty"`  // /me, shown as "* nick text".
+
+	Reactions map[string][]string `json:"reactions,omitempty"` // emoji -> nicks.
+}
+
+type ReactionData struct {
+	ID        string              `json:"id"`
+	Emoji     string              `json:"emoji,omitempty"`
+	Reactions map[string][]string `json:"reactions"`
 }
 
 type MessageCacheResponse struct {
@@ -27,6 +45,33 @@ type MessageCacheResponse struct {
 	Msgs  []MessageData `json:"msgs"`
 }
 
+type ThreadData struct {
+	Parent  MessageData   `json:"parent"`
+	Replies []MessageData `json:"replies"`
+}
+
+type RateLimitData struct {
+	Event      string `json:"event"`
+	RetryAfter int64  `json:"retryAfter"` // milliseconds.
+}
+
+type AccountRequest struct {
+	Nick        string `json:"nick"`
+	Password    string `json:"password"`
+	NewPassword string `json:"newPassword"`
+	Token       string `json:"token"` // -admintoken, to unregister other nicks.
+}
+
+type HistoryRequest struct {
+	Before string `json:"before"`
+	Limit  int    `json:"limit"`
+}
+
+type HistoryPage struct {
+	Msgs    []MessageData `json:"msgs"`
+	HasMore bool          `json:"hasMore"`
+}
+
 // only used for encoding responses, so interface{} is fine.
 type Event struct {
 	Event string      `json:"event"`
@@ -34,11 +79,68 @@ type Event struct {
 }
 
 type EventData struct {
-	Users      []string    `json:"users,omitempty"`
-	Status     bool        `json:"status,omitempty"`
-	Nick       string      `json:"nick,omitempty"`
-	Enabled    bool        `json:"enabled,omitempty"`
-	IceServers interface{} `json:"iceServers,omitempty"`
+	Users      []RosterEntry     `json:"users,omitempty"`
+	Nick       string            `json:"nick,omitempty"`
+	Password   string            `json:"password,omitempty"`
+	Enabled    bool              `json:"enabled,omitempty"`
+	IceServers interface{}       `json:"iceServers,omitempty"`
+	Room       string            `json:"room,omitempty"`
+	Rooms      []RoomInfo        `json:"rooms,omitempty"`
+	Reads      map[string]string `json:"reads,omitempty"`  // nick -> last read message id.
+	Token      string            `json:"token,omitempty"`  // resume token.
+	Upload     string            `json:"upload,omitempty"` // token for POST /upload, in start.
+	Resumed    bool              `json:"resumed,omitempty"`
+	Role       string            `json:"role,omitempty"` // own role, in start.
+	Topic      *Topic            `json:"topic,omitempty"`
+	MOTD       string            `json:"motd,omitempty"`
+	Typing     []string          `json:"typing,omitempty"` // nicks typing in the room, in start.
+}
+
+type RosterEntry struct {
+	Nick   string `json:"nick"`
+	State  string `json:"state"` // online, away, busy or idle.
+	Status string `json:"status,omitempty"`
+}
+
+type PresenceRequest struct {
+	State  string `json:"state"` // online, away or busy.
+	Status string `json:"status"`
+}
+
+type NickChange struct {
+	Old    string `json:"old,omitempty"`
+	Nick   string `json:"nick"`
+	Role   string `json:"role,omitempty"`   // of the new nick, nick-changed only.
+	Reason string `json:"reason,omitempty"` // why the password is asked, nick-password only.
+}
+
+type NoticeData struct {
+	Text string `json:"text"`
+}
+
+type ModerationRequest struct {
+	Nick     string `json:"nick"`
+	IP       string `json:"ip"`
+	Duration string `json:"duration"` // e.g. 10m, empty is the default, 0 is forever for bans.
+	Reason   string `json:"reason"`
+	Role     string `json:"role"`  // set-role only.
+	Token    string `json:"token"` // -admintoken, set-role only.
+}
+
+type ResumeRequest struct {
+	Token  string `json:"token"`
+	LastID string `json:"lastId"` // newest message the client has seen.
+}
+
+type ReceiptData struct {
+	Nick string `json:"nick"`
+	ID   string `json:"id"`
+	Kind string `json:"kind"` // delivered or read.
+}
+
+type RoomInfo struct {
+	Name  string `json:"name"`
+	Users int    `json:"users"`
 }
 
 // structures for WebRTC signaling.
@@ -0,0 +1,107 @@
+// File: typing.go - Who is typing, per room
+// Author: @kimboslice99
+// Created: 2026-10-17
+// License: GNU General Public License v3.0 (GPLv3)
+// Description:
+//  - The typing event only updates the room's state, a nick stops typing when
+//    it says so, sends a message, leaves or disconnects, or after
+//    typingTimeout without a refresh.
+//  - Changes are collected and sent to the room as one typing-list event per
+//    typingInterval at most.
+
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Typing runs out after this long, clients refresh it while typing.
+	typingTimeout = 6 * time.Second
+
+	// Shortest time between two typing-list events of a room.
+	typingInterval = 500 * time.Millisecond
+)
+
+// typingState is who is typing in a room.
+type typingState struct {
+	mu    sync.Mutex
+	nicks map[string]time.Time // nick -> when its typing runs out.
+	sent  []string             // the list the room last got.
+}
+
+// TypingList is the typing-list event, the nicks typing in a room.
+type TypingList struct {
+	Room  string   `json:"room"`
+	Nicks []string `json:"nicks"`
+}
+
+// setTyping; Notes whether nick is typing in the room, the room hears of it
+// with the next typing-list.
+func (h *Hub) setTyping(nick string, typing bool) {
+	h.typing.mu.Lock()
+	defer h.typing.mu.Unlock()
+	if typing {
+		h.typing.nicks[nick] = time.Now().Add(typingTimeout)
+	} else {
+		delete(h.typing.nicks, nick)
+	}
+}
+
+// typingList; Returns the nicks typing in the room, sorted. Expired ones are
+// dropped.
+func (h *Hub) typingList() []string {
+	h.typing.mu.Lock()
+	defer h.typing.mu.Unlock()
+	return h.typing.current(time.Now())
+}
+
+// current; Drops expired nicks and returns the others. Caller holds mu.
+func (t *typingState) current(now time.Time) []string {
+	nicks := []string{}
+	for nick, until := range t.nicks {
+		if now.After(until) {
+			delete(t.nicks, nick)
+			continue
+		}
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// flushTyping; Sends the room a typing-list if it changed since the last one.
+func (h *Hub) flushTyping() {
+	h.typing.mu.Lock()
+	nicks := h.typing.current(time.Now())
+	if slices.Equal(nicks, h.typing.sent) {
+		h.typing.mu.Unlock()
+		return
+	}
+	h.typing.sent = nicks
+	h.typing.mu.Unlock()
+
+	typingJSON, err := json.Marshal(Event{Event: "typing-list", Data: TypingList{Room: h.name, Nicks: nicks}})
+	if err != nil {
+		logger("ERROR", "Failed to encode typing-list event:", err)
+		return
+	}
+	h.emit(typingJSON, nil)
+}
+
+// watchTyping; Sends the typing-list of rooms where it changed, every
+// typingInterval.
+func watchTyping() {
+	ticker := time.NewTicker(typingInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, hub := range rooms.all() {
+			hub.flushTyping()
+		}
+	}
+}